@@ -1,17 +1,32 @@
 package config
 
 import (
+	"bytes"
+	_ "embed"
 	"flag"
 	"fmt"
 	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/barad_ck_push"
+	"github.com/exporterpush/internal/discovery"
+	"github.com/exporterpush/internal/http_json_push"
+	"github.com/exporterpush/internal/node_calc"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/sources"
+	"github.com/exporterpush/pkg/hostfacts"
 	"github.com/exporterpush/pkg/logger"
 	setting2 "github.com/exporterpush/pkg/setting"
 	"github.com/natefinch/lumberjack"
 	"log"
+	"regexp"
+	"strings"
 )
 
 var (
 	configPath string
+
+	// defaultBaradMapping is used when barad.mapping_file is not set
+	//go:embed barad_mapping.yaml
+	defaultBaradMapping []byte
 )
 
 func init() {
@@ -36,6 +51,8 @@ func init() {
 
 func setupFlag() error {
 	flag.StringVar(&configPath, "config", "config/config.yaml", "指定要使用的配置文件路径")
+	flag.BoolVar(&global.DryRun, "dry-run", false, "只打印各插件最终要推送的数据，不发送到网络")
+	flag.StringVar(&global.DryRunFormat, "dry-run-format", "text", "dry-run输出格式: text, json, remote_write")
 	flag.Parse()
 
 	return nil
@@ -56,6 +73,55 @@ func setupSetting() error {
 		return fmt.Errorf("The value of global.scrape_interval must be greater than 15 ")
 	}
 
+	hostfacts.SetMetadataSource(global.GlobalSetting.MetadataSource)
+
+	for _, newFilter := range []func() (*node_calc.Filter, error){node_calc.DiskFilter, node_calc.MountpointFilter, node_calc.InterfaceFilter} {
+		if _, err := newFilter(); err != nil {
+			return err
+		}
+	}
+
+	for _, url := range []string{global.GlobalSetting.ScrapeTargetTypes.NodeExporter, global.GlobalSetting.ScrapeTargetTypes.ClickhouseExporter} {
+		if err := scrape.CheckURL(url); err != nil {
+			return err
+		}
+	}
+
+	err = setting.ReadSection("scrape_configs", &global.ScrapeConfigs)
+	if err != nil {
+		return err
+	}
+
+	if err := scrape.CheckScrapeConfigs(global.ScrapeConfigs); err != nil {
+		return err
+	}
+
+	err = setting.ReadSection("sources", &global.SourcesSetting)
+	if err != nil {
+		return err
+	}
+
+	if _, err := sources.NewGatherer(global.SourcesSetting); err != nil {
+		return err
+	}
+
+	err = setting.ReadSection("receiver", &global.ReceiverSetting)
+	if err != nil {
+		return err
+	}
+
+	if global.ReceiverSetting == nil {
+		global.ReceiverSetting = &setting2.ReceiverS{}
+	}
+
+	if _, err := scrape.NewRelabelConfigs(global.ReceiverSetting.RelabelConfigs); err != nil {
+		return fmt.Errorf("receiver %v", err)
+	}
+
+	if err := scrape.LoadPushed(); err != nil {
+		return fmt.Errorf("receiver pushgateway %v", err)
+	}
+
 	err = setting.ReadSection("barad", &global.BaradSetting)
 	if err != nil {
 		return err
@@ -71,6 +137,41 @@ func setupSetting() error {
 		return err
 	}
 
+	err = setting.ReadSection("file", &global.FileSetting)
+	if err != nil {
+		return err
+	}
+
+	err = setupFileSetting()
+	if err != nil {
+		return err
+	}
+
+	err = setting.ReadSection("stdout", &global.StdoutSetting)
+	if err != nil {
+		return err
+	}
+
+	err = setupStdoutSetting()
+	if err != nil {
+		return err
+	}
+
+	err = setting.ReadSection("http_json", &global.HttpJsonSettings)
+	if err != nil {
+		return err
+	}
+
+	err = setupHttpJsonSetting()
+	if err != nil {
+		return err
+	}
+
+	err = setupBaradMapping()
+	if err != nil {
+		return err
+	}
+
 	if len(global.BaradSetting.StaticConfigs) <= 0 {
 		return fmt.Errorf("barad static_configs is nil")
 	}
@@ -79,12 +180,210 @@ func setupSetting() error {
 		return fmt.Errorf("barad destination is nil")
 	}
 
+	if err := barad_ck_push.CheckDimensions(global.BaradSetting); err != nil {
+		return err
+	}
+
+	if global.BaradSetting.Timeout <= 0 {
+		global.BaradSetting.Timeout = 10
+	}
+
+	if global.BaradSetting.RetryBackoff <= 0 {
+		global.BaradSetting.RetryBackoff = 1000
+	}
+
 	if len(global.PushgatewaySetting.StaticConfigs) <= 0 {
 		return fmt.Errorf("pushgateway static_configs is nil")
 	}
 
-	if len(global.PushgatewaySetting.StaticConfigs[0].Destination) <= 0 {
-		return fmt.Errorf("pushgateway destination is nil")
+	if _, err := discovery.NewDestinations(global.PushgatewaySetting.StaticConfigs[0].Destination,
+		global.PushgatewaySetting.DestinationSD, discovery.ModeFanout, nil); err != nil {
+		return fmt.Errorf("pushgateway %v", err)
+	}
+
+	if global.PrometheusSetting.IsUse {
+		if len(global.PrometheusSetting.StaticConfigs) <= 0 {
+			return fmt.Errorf("prometheus static_configs is nil")
+		}
+		// the discovered addresses are remote write urls of Prometheus
+		if global.PrometheusSetting.DestinationSD.Path == "" {
+			global.PrometheusSetting.DestinationSD.Path = "/api/v1/write"
+		}
+		if _, err := discovery.NewDestinations(global.PrometheusSetting.StaticConfigs[0].Destination,
+			global.PrometheusSetting.DestinationSD, discovery.ModeFailover, nil); err != nil {
+			return fmt.Errorf("prometheus %v", err)
+		}
+	}
+
+	switch global.PushgatewaySetting.Method {
+	case "":
+		global.PushgatewaySetting.Method = "put"
+	case "put", "post":
+	default:
+		return fmt.Errorf("pushgateway method %q is not one of put, post", global.PushgatewaySetting.Method)
+	}
+
+	return nil
+}
+
+// setupBaradMapping read the barad metric mapping list, the built-in default when no mapping_file is set
+func setupBaradMapping() error {
+	var (
+		mappingSetting *setting2.Setting
+		err            error
+	)
+	if global.BaradSetting.MappingFile != "" {
+		mappingSetting, err = setting2.NewSetting(global.BaradSetting.MappingFile)
+	} else {
+		mappingSetting, err = setting2.NewSettingFromReader(bytes.NewReader(defaultBaradMapping), "yaml")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = mappingSetting.ReadSection("mappings", &global.BaradMappings)
+	if err != nil {
+		return err
+	}
+
+	for i := range global.BaradMappings {
+		m := &global.BaradMappings[i]
+
+		if m.Name == "" || m.Source.Metric == "" {
+			return fmt.Errorf("barad mapping %v needs a name and a source metric", i)
+		}
+
+		switch m.Aggregation {
+		case "":
+			m.Aggregation = "sum"
+		case "sum", "avg", "max", "min", "count":
+		default:
+			return fmt.Errorf("barad mapping %v aggregation %q is not one of sum, avg, max, min, count", m.Name, m.Aggregation)
+		}
+
+		for _, sel := range []setting2.MetricSelector{m.Source, m.Divisor} {
+			for name, value := range sel.Labels {
+				if strings.HasPrefix(value, "=~") || strings.HasPrefix(value, "!~") {
+					if _, err := regexp.Compile(value[2:]); err != nil {
+						return fmt.Errorf("barad mapping %v label %v matcher %q error: %v", m.Name, name, value, err)
+					}
+				}
+			}
+
+			switch sel.Field {
+			case "", "sum", "count":
+			default:
+				return fmt.Errorf("barad mapping %v field %q is not one of sum, count", m.Name, sel.Field)
+			}
+		}
+
+		switch m.Transform {
+		case "":
+			m.Transform = "raw"
+		case "raw", "delta", "rate":
+		case "ratio":
+			if m.Divisor.Metric == "" {
+				return fmt.Errorf("barad mapping %v uses the ratio transform without a divisor metric", m.Name)
+			}
+		default:
+			return fmt.Errorf("barad mapping %v transform %q is not one of raw, delta, rate, ratio", m.Name, m.Transform)
+		}
+
+		if m.Scale == 0 {
+			m.Scale = 1
+		}
+
+		if m.Precision == nil {
+			precision := 2
+			m.Precision = &precision
+		}
+	}
+
+	return nil
+}
+
+// setupFileSetting fills in the defaults of the optional file section,
+// so configs written before the file sink existed keep loading
+func setupFileSetting() error {
+	if global.FileSetting == nil {
+		global.FileSetting = &setting2.FileS{}
+	}
+
+	if global.FileSetting.Path == "" {
+		global.FileSetting.Path = "/tmp/exporterpush"
+	}
+
+	if global.FileSetting.FileName == "" {
+		global.FileSetting.FileName = "metrics"
+	}
+
+	if global.FileSetting.Format == "" {
+		global.FileSetting.Format = "ndjson"
+	}
+
+	if global.FileSetting.MaxSize <= 0 {
+		global.FileSetting.MaxSize = 100
+	}
+
+	switch global.FileSetting.Format {
+	case "text", "ndjson", "remote_write":
+	default:
+		return fmt.Errorf("file format %q is not one of text, ndjson, remote_write", global.FileSetting.Format)
+	}
+
+	return nil
+}
+
+// setupHttpJsonSetting apply the preset of every http_json sink and check its body template or mapping
+func setupHttpJsonSetting() error {
+	names := map[string]bool{}
+
+	for i := range global.HttpJsonSettings {
+		s := &global.HttpJsonSettings[i]
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("http_json_%v", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("http_json name %q is used twice", s.Name)
+		}
+		names[s.Name] = true
+
+		if !s.IsUse {
+			continue
+		}
+
+		if err := http_json_push.ApplyPreset(s); err != nil {
+			return err
+		}
+
+		if len(s.StaticConfigs) <= 0 || len(s.StaticConfigs[0].Destination) <= 0 {
+			return fmt.Errorf("http_json %v destination is nil", s.Name)
+		}
+
+		if _, err := http_json_push.NewEncoder(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupStdoutSetting fills in the defaults of the optional stdout section and checks the output formats
+func setupStdoutSetting() error {
+	if global.StdoutSetting == nil {
+		global.StdoutSetting = &setting2.StdoutS{}
+	}
+
+	if global.StdoutSetting.Format == "" {
+		global.StdoutSetting.Format = "text"
+	}
+
+	for _, format := range []string{global.StdoutSetting.Format, global.DryRunFormat} {
+		switch format {
+		case "text", "json", "remote_write":
+		default:
+			return fmt.Errorf("stdout format %q is not one of text, json, remote_write", format)
+		}
 	}
 
 	return nil
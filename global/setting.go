@@ -8,9 +8,20 @@ import (
 var (
 	GlobalSetting      *setting.GlobalS
 	BaradSetting       *setting.BaradS
+	BaradMappings      []setting.BaradMetricMapping
 	PrometheusSetting  *setting.PrometheusS
 	PushgatewaySetting *setting.PushgatewayS
+	FileSetting        *setting.FileS
+	StdoutSetting      *setting.StdoutS
+	HttpJsonSettings   []setting.HttpJsonS
+	SourcesSetting     *setting.SourcesS
+	ScrapeConfigs      []setting.ScrapeConfigS
+	ReceiverSetting    *setting.ReceiverS
 	LogObj             *logger.Logger
+
+	// DryRun makes every sink print its final payload to stdout instead of sending it
+	DryRun       bool
+	DryRunFormat string
 )
 
 const (
@@ -0,0 +1,109 @@
+package barad_ck_push
+
+import (
+	"fmt"
+	"github.com/exporterpush/internal/model"
+	"github.com/exporterpush/pkg/hostfacts"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// renderDimensions resolve the dimension templates of s, see hostfacts.Render. Besides the host
+// facts and the destination labels, `{{scraped "metric" "label"}}` gives the label value of the
+// first series of a scraped metric. A template that fails to render leaves its dimension empty,
+// the error lists every failed dimension
+func renderDimensions(s *setting.BaradS, families map[string]*prom2json.Family) (model.Dimensions, error) {
+	labels := map[string]string{}
+	if len(s.StaticConfigs) > 0 {
+		labels = s.StaticConfigs[0].Labels
+	}
+
+	funcs := dimensionFuncs(families)
+	errs := []string{}
+	render := func(name, text string) string {
+		value, err := hostfacts.RenderFuncs(text, labels, funcs)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+		return value
+	}
+
+	dimension := model.Dimensions{
+		AppId:      render("app_id", s.AppId),
+		InstanceId: render("instance_id", s.InstanceId),
+		NodeId:     render("node_id", s.NodeId),
+		ProjectId:  render("project_id", s.ProjectId),
+	}
+
+	if len(s.Dimensions) > 0 {
+		dimension.Extra = make(map[string]string, len(s.Dimensions))
+		for name, text := range s.Dimensions {
+			dimension.Extra[name] = render(name, text)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return dimension, fmt.Errorf("render barad dimensions error: %v", strings.Join(errs, "; "))
+	}
+
+	return dimension, nil
+}
+
+// CheckDimensions parse every dimension template of s, so a broken one fails at config load
+// instead of at every push
+func CheckDimensions(s *setting.BaradS) error {
+	templates := map[string]string{
+		"app_id":      s.AppId,
+		"instance_id": s.InstanceId,
+		"node_id":     s.NodeId,
+		"project_id":  s.ProjectId,
+	}
+	for name, text := range s.Dimensions {
+		templates[name] = text
+	}
+
+	errs := []string{}
+	funcs := dimensionFuncs(nil)
+	for name, text := range templates {
+		if err := hostfacts.Check(text, funcs); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("barad dimensions error: %v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// dimensionFuncs return the template functions of the dimensions besides the host facts
+func dimensionFuncs(families map[string]*prom2json.Family) template.FuncMap {
+	return template.FuncMap{
+		"scraped": func(metric, label string) (string, error) {
+			family, ok := families[metric]
+			if !ok || len(family.Metrics) == 0 {
+				return "", fmt.Errorf("metric %v %w", metric, ErrMetricAbsent)
+			}
+			return seriesLabels(family.Metrics[0])[label], nil
+		},
+	}
+}
+
+func seriesLabels(item interface{}) map[string]string {
+	switch metric := item.(type) {
+	case prom2json.Metric:
+		return metric.Labels
+	case prom2json.Summary:
+		return metric.Labels
+	case prom2json.Histogram:
+		return metric.Labels
+	}
+
+	return nil
+}
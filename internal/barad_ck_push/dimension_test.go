@@ -0,0 +1,80 @@
+package barad_ck_push
+
+import (
+	"encoding/json"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderDimensions(t *testing.T) {
+	os.Setenv("BARAD_TEST_PROJECT", "7")
+	defer os.Unsetenv("BARAD_TEST_PROJECT")
+
+	s := &setting.BaradS{
+		AppId:      "1251",
+		InstanceId: `{{scraped "ClickHouseMetrics_TCPConnection" "instance"}}`,
+		NodeId:     "{{hostname}}",
+		ProjectId:  `{{env "BARAD_TEST_PROJECT"}}`,
+		Dimensions: map[string]string{"region": "gz", "broken": `{{scraped "not_scraped" "x"}}`},
+	}
+	families := map[string]*prom2json.Family{
+		"ClickHouseMetrics_TCPConnection": family("ClickHouseMetrics_TCPConnection", "GAUGE",
+			prom2json.Metric{Labels: map[string]string{"instance": "cdw-1"}, Value: "1"}),
+	}
+
+	dimension, err := renderDimensions(s, families)
+	if err == nil {
+		t.Error("expected an error for the absent scraped metric")
+	}
+
+	body, _ := json.Marshal(dimension)
+	got := map[string]string{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+	want := map[string]string{
+		"appid":      "1251",
+		"instanceid": "cdw-1",
+		"nodeid":     hostname,
+		"projectid":  "7",
+		"region":     "gz",
+		"broken":     "",
+	}
+	if len(got) != len(want) {
+		t.Errorf("dimension = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("dimension %v = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestCheckDimensions(t *testing.T) {
+	s := &setting.BaradS{
+		AppId:      "1251",
+		InstanceId: `{{scraped "ClickHouseMetrics_TCPConnection" "instance"}}`,
+		NodeId:     "{{hostname}}",
+		Dimensions: map[string]string{"region": `{{env "REGION"}}`},
+	}
+	if err := CheckDimensions(s); err != nil {
+		t.Errorf("valid dimensions rejected: %v", err)
+	}
+
+	s.Dimensions["broken"] = "{{hostnme}}"
+	s.ProjectId = "{{env"
+	err := CheckDimensions(s)
+	if err == nil {
+		t.Fatal("expected the unknown function and the unclosed action to be reported")
+	}
+	for _, name := range []string{"broken", "project_id"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %v does not name %v", err, name)
+		}
+	}
+}
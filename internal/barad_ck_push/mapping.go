@@ -0,0 +1,314 @@
+package barad_ck_push
+
+import (
+	"errors"
+	"fmt"
+	"github.com/exporterpush/internal/model"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/rate"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateMaxAge drops previous values older than it, a rate over a longer gap is not reported and
+// the series gone for longer are forgotten
+const stateMaxAge = time.Hour
+
+// MappingState keeps the previous source values of the delta and rate mappings
+type MappingState struct {
+	tracker *rate.Tracker
+}
+
+// NewMappingState return a MappingState persisting the previous values to path, an empty path keeps them in memory
+func NewMappingState(path string) (*MappingState, error) {
+	tracker, err := rate.NewTracker(path)
+	tracker.MaxAge = stateMaxAge
+
+	return &MappingState{tracker: tracker}, err
+}
+
+// Save persist the previous values so a restarted agent continues from them
+func (s *MappingState) Save() error {
+	return s.tracker.Save()
+}
+
+// Evaluate calculate the barad batch items of mappings from families collected at now. A mapping
+// whose source is absent, or a delta or rate mapping without a previous value yet, is left out;
+// the names of the mappings left out because a metric is absent are returned.
+// Delta and rate are taken per series before the aggregation, so a series that resets or
+// disappears does not turn the whole aggregate into the delta. A decreasing series of a
+// counter family is a counter reset, and rates are per second of the real time elapsed
+// between the two samples
+func (s *MappingState) Evaluate(mappings []setting.BaradMetricMapping, families map[string]*prom2json.Family,
+	now time.Time) ([]model.Batchs, []string) {
+
+	metricList := []model.Batchs{}
+	absent := []string{}
+
+	for _, m := range mappings {
+		series, err := selectSeries(families, m.Source)
+		if err != nil {
+			absent = append(absent, fmt.Sprintf("%v(%v)", m.Name, err))
+			continue
+		}
+
+		counter := families[m.Source.Metric].Type == "COUNTER"
+
+		var value float64
+		switch m.Transform {
+		case "delta", "rate":
+			increases := []float64{}
+			for _, sv := range series {
+				delta, elapsed, ok := s.tracker.Delta(m.Name+"\xff"+sv.key, sv.value, now, counter)
+				if !ok {
+					continue
+				}
+				if m.Transform == "rate" {
+					delta = delta / elapsed.Seconds()
+				}
+				increases = append(increases, delta)
+			}
+			if len(increases) == 0 {
+				continue
+			}
+			value = aggregate(increases, m.Aggregation)
+
+		case "ratio":
+			value = aggregate(seriesValues(series), m.Aggregation)
+			divisor, err := selectValue(families, m.Divisor, m.Aggregation)
+			if err != nil {
+				absent = append(absent, fmt.Sprintf("%v(%v)", m.Name, err))
+				continue
+			}
+			if divisor == 0 {
+				continue
+			}
+			value = value / divisor
+
+		default:
+			value = aggregate(seriesValues(series), m.Aggregation)
+		}
+
+		metricList = append(metricList, model.Batchs{
+			Unit:  m.Unit,
+			Name:  m.Name,
+			Value: util.Decimal(value*m.Scale, *m.Precision),
+		})
+	}
+
+	return metricList, absent
+}
+
+// ErrMetricAbsent is returned when no series of the selected metric exists
+var ErrMetricAbsent = errors.New("metric absent")
+
+// seriesValue is the value of one selected series, key identifies it by its sorted labels
+type seriesValue struct {
+	key   string
+	value float64
+}
+
+// selectValue aggregate the values of every series of sel.Metric matching the sel.Labels matchers
+func selectValue(families map[string]*prom2json.Family, sel setting.MetricSelector, aggregation string) (float64, error) {
+	series, err := selectSeries(families, sel)
+	if err != nil {
+		return 0, err
+	}
+
+	return aggregate(seriesValues(series), aggregation), nil
+}
+
+// selectSeries return every series of sel.Metric matching the sel.Labels matchers.
+// Counter, gauge and untyped series give their value, summary and histogram series their sum
+// or count as chosen by sel.Field
+func selectSeries(families map[string]*prom2json.Family, sel setting.MetricSelector) ([]seriesValue, error) {
+	family, ok := families[sel.Metric]
+	if !ok {
+		return nil, fmt.Errorf("%v %w", sel.Metric, ErrMetricAbsent)
+	}
+
+	matchers, err := parseMatchers(sel.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []seriesValue{}
+	for _, item := range family.Metrics {
+		var labels map[string]string
+		var valueStr string
+
+		switch metric := item.(type) {
+		case prom2json.Metric:
+			labels, valueStr = metric.Labels, metric.Value
+		case prom2json.Summary:
+			labels, valueStr = metric.Labels, metric.Sum
+			if sel.Field == "count" {
+				valueStr = metric.Count
+			}
+		case prom2json.Histogram:
+			labels, valueStr = metric.Labels, metric.Sum
+			if sel.Field == "count" {
+				valueStr = metric.Count
+			}
+		default:
+			continue
+		}
+
+		if !matchLabels(labels, matchers) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, seriesValue{key: seriesKey(labels), value: value})
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%v%v %w", sel.Metric, sel.Labels, ErrMetricAbsent)
+	}
+
+	return result, nil
+}
+
+func seriesValues(series []seriesValue) []float64 {
+	values := make([]float64, len(series))
+	for i, sv := range series {
+		values[i] = sv.value
+	}
+
+	return values
+}
+
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := ""
+	for _, name := range names {
+		key += name + "=" + labels[name] + ","
+	}
+
+	return key
+}
+
+// aggregate the values with sum, avg, max, min or count, sum by default
+func aggregate(values []float64, aggregation string) float64 {
+	result := values[0]
+	switch aggregation {
+	case "max":
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+	case "min":
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+	case "count":
+		result = float64(len(values))
+	default:
+		for _, v := range values[1:] {
+			result += v
+		}
+		if aggregation == "avg" {
+			result = result / float64(len(values))
+		}
+	}
+
+	return result
+}
+
+type labelMatcher struct {
+	name     string
+	value    string
+	regex    *regexp.Regexp
+	negative bool
+}
+
+var (
+	matcherCache   = map[string]labelMatcher{}
+	matcherCacheMu sync.Mutex
+)
+
+// parseMatcher parse a selector label value: "v" or "=v" equal, "!=v" not equal,
+// "=~re" regex match and "!~re" regex not match, regexes are anchored like in PromQL
+func parseMatcher(name, value string) (labelMatcher, error) {
+	m := labelMatcher{name: name}
+
+	var expr string
+	switch {
+	case strings.HasPrefix(value, "=~"):
+		expr = value[2:]
+	case strings.HasPrefix(value, "!~"):
+		expr, m.negative = value[2:], true
+	case strings.HasPrefix(value, "!="):
+		m.value, m.negative = value[2:], true
+	case strings.HasPrefix(value, "="):
+		m.value = value[1:]
+	default:
+		m.value = value
+	}
+
+	if expr != "" {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return m, fmt.Errorf("label %v matcher %q error: %v", name, value, err)
+		}
+		m.regex = re
+	}
+
+	return m, nil
+}
+
+func parseMatchers(selector map[string]string) ([]labelMatcher, error) {
+	matcherCacheMu.Lock()
+	defer matcherCacheMu.Unlock()
+
+	matchers := make([]labelMatcher, 0, len(selector))
+	for name, value := range selector {
+		key := name + "\xff" + value
+		m, ok := matcherCache[key]
+		if !ok {
+			var err error
+			if m, err = parseMatcher(name, value); err != nil {
+				return nil, err
+			}
+			matcherCache[key] = m
+		}
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+func (m labelMatcher) matches(labels map[string]string) bool {
+	var ok bool
+	if m.regex != nil {
+		ok = m.regex.MatchString(labels[m.name])
+	} else {
+		ok = labels[m.name] == m.value
+	}
+
+	return ok != m.negative
+}
+
+func matchLabels(labels map[string]string, matchers []labelMatcher) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,252 @@
+package barad_ck_push
+
+import (
+	"errors"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"testing"
+	"time"
+)
+
+func family(name, metricType string, series ...interface{}) *prom2json.Family {
+	f := &prom2json.Family{Name: name, Type: metricType}
+	for _, s := range series {
+		f.Metrics = append(f.Metrics, s)
+	}
+
+	return f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestMappingEvaluate(t *testing.T) {
+	mappings := []setting.BaradMetricMapping{
+		{Name: "tcp_connection", Unit: "count", Source: setting.MetricSelector{Metric: "ClickHouseMetrics_TCPConnection"},
+			Aggregation: "sum", Transform: "raw", Scale: 1, Precision: intPtr(2)},
+		{Name: "default_parts", Unit: "count",
+			Source:      setting.MetricSelector{Metric: "parts", Labels: map[string]string{"database": "default"}},
+			Aggregation: "max", Transform: "raw", Scale: 1, Precision: intPtr(2)},
+		{Name: "query_count", Unit: "count", Source: setting.MetricSelector{Metric: "ClickHouseProfileEvents_Query"},
+			Aggregation: "sum", Transform: "rate", Scale: 1, Precision: intPtr(2)},
+		{Name: "mem_use_rate", Unit: "%", Source: setting.MetricSelector{Metric: "used"},
+			Divisor: setting.MetricSelector{Metric: "total"}, Aggregation: "sum", Transform: "ratio", Scale: 100, Precision: intPtr(1)},
+		{Name: "missing", Unit: "count", Source: setting.MetricSelector{Metric: "not_scraped"},
+			Aggregation: "sum", Transform: "raw", Scale: 1, Precision: intPtr(2)},
+	}
+
+	scrape := func(queries string) map[string]*prom2json.Family {
+		return map[string]*prom2json.Family{
+			"ClickHouseMetrics_TCPConnection": family("ClickHouseMetrics_TCPConnection", "GAUGE",
+				prom2json.Metric{Value: "3"}, prom2json.Metric{Value: "4"}),
+			"parts": family("parts", "GAUGE",
+				prom2json.Metric{Labels: map[string]string{"database": "default", "table": "a"}, Value: "10"},
+				prom2json.Metric{Labels: map[string]string{"database": "default", "table": "b"}, Value: "30"},
+				prom2json.Metric{Labels: map[string]string{"database": "system", "table": "c"}, Value: "99"}),
+			"ClickHouseProfileEvents_Query": family("ClickHouseProfileEvents_Query", "COUNTER", prom2json.Metric{Value: queries}),
+			"used":                          family("used", "GAUGE", prom2json.Metric{Value: "1"}),
+			"total":                         family("total", "GAUGE", prom2json.Metric{Value: "3"}),
+		}
+	}
+
+	state, _ := NewMappingState("")
+	start := time.Unix(1650000000, 0)
+
+	// the first evaluation has no previous value for the rate mapping
+	first := map[string]float64{}
+	batch, _ := state.Evaluate(mappings, scrape("100"), start)
+	for _, b := range batch {
+		first[b.Name] = b.Value
+	}
+	if _, ok := first["query_count"]; ok {
+		t.Error("rate mapping reported without a previous value")
+	}
+
+	got := map[string]float64{}
+	batch, absent := state.Evaluate(mappings, scrape("250"), start.Add(15*time.Second))
+	for _, b := range batch {
+		got[b.Name] = b.Value
+	}
+	if len(absent) != 1 {
+		t.Errorf("absent mappings = %v, want only missing", absent)
+	}
+
+	want := map[string]float64{
+		"tcp_connection": 7,
+		"default_parts":  30,
+		"query_count":    10,
+		"mem_use_rate":   33.3,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%v = %v, want %v", name, got[name], value)
+		}
+	}
+	if _, ok := got["missing"]; ok {
+		t.Error("absent source reported")
+	}
+}
+
+func TestMappingDeltaPerSeries(t *testing.T) {
+	mappings := []setting.BaradMetricMapping{
+		{Name: "inserted_rows", Unit: "count", Source: setting.MetricSelector{Metric: "inserted"},
+			Aggregation: "sum", Transform: "delta", Scale: 1, Precision: intPtr(2)},
+		{Name: "untyped_delta", Unit: "count", Source: setting.MetricSelector{Metric: "level"},
+			Aggregation: "sum", Transform: "delta", Scale: 1, Precision: intPtr(2)},
+	}
+	scrape := func(a, b, level string) map[string]*prom2json.Family {
+		series := []interface{}{prom2json.Metric{Labels: map[string]string{"table": "a"}, Value: a}}
+		if b != "" {
+			series = append(series, prom2json.Metric{Labels: map[string]string{"table": "b"}, Value: b})
+		}
+		return map[string]*prom2json.Family{
+			"inserted": family("inserted", "COUNTER", series...),
+			"level":    family("level", "UNTYPED", prom2json.Metric{Value: level}),
+		}
+	}
+
+	state, _ := NewMappingState("")
+	start := time.Unix(1650000000, 0)
+	evaluate := func(families map[string]*prom2json.Family, at time.Time) map[string]float64 {
+		got := map[string]float64{}
+		batch, _ := state.Evaluate(mappings, families, at)
+		for _, b := range batch {
+			got[b.Name] = b.Value
+		}
+		return got
+	}
+
+	evaluate(scrape("1000", "5000", "50"), start)
+	// table b restarted from zero: its own value is its increase, table a keeps its delta
+	got := evaluate(scrape("1100", "30", "40"), start.Add(15*time.Second))
+	if got["inserted_rows"] != 130 {
+		t.Errorf("inserted_rows = %v, want 100 of a plus 30 of the reset b", got["inserted_rows"])
+	}
+	// an untyped series is not a counter, a decrease is a negative delta
+	if got["untyped_delta"] != -10 {
+		t.Errorf("untyped_delta = %v, want -10", got["untyped_delta"])
+	}
+
+	// table b disappeared, the sum is the delta of a only
+	got = evaluate(scrape("1150", "", "40"), start.Add(30*time.Second))
+	if got["inserted_rows"] != 50 {
+		t.Errorf("inserted_rows = %v, want 50 of a", got["inserted_rows"])
+	}
+}
+
+func TestSelectValueMatchers(t *testing.T) {
+	families := map[string]*prom2json.Family{
+		"ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables": family("rows", "GAUGE",
+			prom2json.Metric{Labels: map[string]string{"database": "default", "table": "hits"}, Value: "10"},
+			prom2json.Metric{Labels: map[string]string{"database": "default", "table": "visits"}, Value: "20"},
+			prom2json.Metric{Labels: map[string]string{"database": "system", "table": "query_log"}, Value: "40"}),
+		"query_duration": family("query_duration", "SUMMARY",
+			prom2json.Summary{Labels: map[string]string{"type": "select"}, Count: "4", Sum: "2.5"}),
+	}
+
+	cases := []struct {
+		sel         setting.MetricSelector
+		aggregation string
+		want        float64
+	}{
+		{setting.MetricSelector{Metric: "ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables"}, "sum", 70},
+		{setting.MetricSelector{Metric: "ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables",
+			Labels: map[string]string{"database": "!=system"}}, "sum", 30},
+		{setting.MetricSelector{Metric: "ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables",
+			Labels: map[string]string{"table": "=~hits|query_.*"}}, "max", 40},
+		{setting.MetricSelector{Metric: "ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables",
+			Labels: map[string]string{"database": "!~sys.*"}}, "count", 2},
+		{setting.MetricSelector{Metric: "query_duration"}, "sum", 2.5},
+		{setting.MetricSelector{Metric: "query_duration", Field: "count"}, "sum", 4},
+	}
+
+	for _, c := range cases {
+		got, err := selectValue(families, c.sel, c.aggregation)
+		if err != nil {
+			t.Errorf("%+v: %v", c.sel, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%+v %v = %v, want %v", c.sel, c.aggregation, got, c.want)
+		}
+	}
+
+	_, err := selectValue(families, setting.MetricSelector{Metric: "ClickHouseAsyncMetrics_TotalRowsOfMergeTreeTables",
+		Labels: map[string]string{"database": "nope"}}, "sum")
+	if !errors.Is(err, ErrMetricAbsent) {
+		t.Errorf("no matching series should be absent, got %v", err)
+	}
+
+	_, err = selectValue(families, setting.MetricSelector{Metric: "not_scraped"}, "sum")
+	if !errors.Is(err, ErrMetricAbsent) {
+		t.Errorf("missing family should be absent, got %v", err)
+	}
+}
+
+func TestDefaultMappingFile(t *testing.T) {
+	mappingSetting, err := setting.NewSetting("../../config/barad_mapping.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := []setting.BaradMetricMapping{}
+	if err := mappingSetting.ReadSection("mappings", &mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, m := range mappings {
+		if m.Name == "" || m.Source.Metric == "" {
+			t.Errorf("incomplete mapping: %+v", m)
+		}
+		names[m.Name] = true
+	}
+
+	for _, name := range []string{"cpu_use_rate", "io_read_bytes", "tcp_connection", "qps_count", "data_part_count"} {
+		if !names[name] {
+			t.Errorf("default mapping lacks %v", name)
+		}
+	}
+}
+
+func TestDefaultMappingDeviceDropsOut(t *testing.T) {
+	mappingSetting, err := setting.NewSetting("../../config/barad_mapping.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := []setting.BaradMetricMapping{}
+	if err := mappingSetting.ReadSection("mappings", &all); err != nil {
+		t.Fatal(err)
+	}
+	mappings := []setting.BaradMetricMapping{}
+	for _, m := range all {
+		if m.Name == "io_read_bytes" {
+			// the defaults config.go fills in
+			m.Aggregation, m.Scale, m.Precision = "sum", 1, intPtr(2)
+			mappings = append(mappings, m)
+		}
+	}
+	if len(mappings) != 1 {
+		t.Fatal("default mapping lacks io_read_bytes")
+	}
+
+	device := func(name, value string) prom2json.Metric {
+		return prom2json.Metric{Labels: map[string]string{"device": name}, Value: value}
+	}
+	state, _ := NewMappingState("")
+	start := time.Unix(1650000000, 0)
+
+	state.Evaluate(mappings, map[string]*prom2json.Family{
+		"host_disk_read_bytes_total": family("host_disk_read_bytes_total", "COUNTER",
+			device("sda", "1000"), device("sdb", "5000"), device("all", "6000")),
+	}, start)
+	// sdb dropped out, the "all" total fell but no device restarted
+	batch, _ := state.Evaluate(mappings, map[string]*prom2json.Family{
+		"host_disk_read_bytes_total": family("host_disk_read_bytes_total", "COUNTER",
+			device("sda", "1150"), device("all", "1150")),
+	}, start.Add(15*time.Second))
+	if len(batch) != 1 || batch[0].Value != 10 {
+		t.Errorf("batch = %+v, want io_read_bytes 10 of sda alone", batch)
+	}
+}
@@ -0,0 +1,300 @@
+package clickhouse_calc
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURL is the HTTP interface of a local ClickHouse server
+	DefaultURL = "http://127.0.0.1:8123"
+
+	defaultTimeout = 10
+)
+
+var (
+	scrapeSuccessDesc = prometheus.NewDesc("clickhouse_scrape_collector_success",
+		"Whether reading a ClickHouse system table succeeded.", []string{"collector"}, nil)
+	scrapeDurationDesc = prometheus.NewDesc("clickhouse_scrape_collector_duration_seconds",
+		"Duration of reading a ClickHouse system table.", []string{"collector"}, nil)
+
+	partLabels      = []string{"database", "table", "partition"}
+	partsCountDesc  = prometheus.NewDesc("ClickHouseParts_count", "Active parts of the partition.", partLabels, nil)
+	partsRowsDesc   = prometheus.NewDesc("ClickHouseParts_rows", "Rows in the active parts of the partition.", partLabels, nil)
+	partsBytesDesc  = prometheus.NewDesc("ClickHouseParts_bytes_on_disk", "Bytes on disk of the active parts of the partition.", partLabels, nil)
+	partsMaxDesc    = prometheus.NewDesc("ClickHouseParts_max_per_partition", "Active parts of the partition of the table with the most of them.", []string{"database", "table"}, nil)
+	replicaLabels   = []string{"database", "table"}
+	replicaColumns  = []string{"is_readonly", "is_session_expired", "absolute_delay", "queue_size", "inserts_in_queue", "merges_in_queue", "total_replicas", "active_replicas"}
+	replicaDescs    = map[string]*prometheus.Desc{}
+	invalidNameChar = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+)
+
+func init() {
+	help := map[string]string{
+		"is_readonly":        "Whether the replica is in readonly mode.",
+		"is_session_expired": "Whether the ZooKeeper session of the replica expired.",
+		"absolute_delay":     "Seconds the replica lags behind, its replication delay.",
+		"queue_size":         "Size of the replication queue of the replica.",
+		"inserts_in_queue":   "Inserts waiting in the replication queue of the replica.",
+		"merges_in_queue":    "Merges waiting in the replication queue of the replica.",
+		"total_replicas":     "Known replicas of the table.",
+		"active_replicas":    "Replicas of the table with a ZooKeeper session.",
+	}
+	for _, column := range replicaColumns {
+		name := "ClickHouseReplicas_" + column
+		if column == "absolute_delay" {
+			name += "_seconds"
+		}
+		replicaDescs[column] = prometheus.NewDesc(name, help[column], replicaLabels, nil)
+	}
+}
+
+// Collector reads the system tables of a ClickHouse server over its HTTP interface:
+// system.metrics as ClickHouseMetrics_*, system.events as ClickHouseProfileEvents_*,
+// system.asynchronous_metrics as ClickHouseAsyncMetrics_*, and the active parts per partition
+// and the state of the replicas of system.parts and system.replicas. Its metric names depend
+// on the server, so it describes nothing and is registered as an unchecked collector
+type Collector struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// NewCollector return the Collector of the server in s, DefaultURL when s has none
+func NewCollector(s setting.ClickhouseS) *Collector {
+	c := &Collector{url: s.URL, user: s.User, password: s.Password}
+	if c.url == "" {
+		c.url = DefaultURL
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	return c
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range []struct {
+		name    string
+		collect func(ch chan<- prometheus.Metric) error
+	}{
+		{"metrics", c.collectMetrics},
+		{"events", c.collectEvents},
+		{"asynchronous_metrics", c.collectAsyncMetrics},
+		{"parts", c.collectParts},
+		{"replicas", c.collectReplicas},
+	} {
+		begin := time.Now()
+		err := t.collect(ch)
+		duration := time.Since(begin)
+
+		success := 1.0
+		if err != nil {
+			success = 0
+			global.LogObj.Errorf("builtin clickhouse collector %v error: %v", t.name, err)
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), t.name)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, t.name)
+	}
+}
+
+func (c *Collector) collectMetrics(ch chan<- prometheus.Metric) error {
+	return c.collectNameValues(ch, "SELECT metric, value FROM system.metrics", "ClickHouseMetrics_",
+		"ClickHouse metric from system.metrics.", prometheus.GaugeValue)
+}
+
+func (c *Collector) collectEvents(ch chan<- prometheus.Metric) error {
+	return c.collectNameValues(ch, "SELECT event, value FROM system.events", "ClickHouseProfileEvents_",
+		"ClickHouse profile event from system.events.", prometheus.CounterValue)
+}
+
+func (c *Collector) collectAsyncMetrics(ch chan<- prometheus.Metric) error {
+	return c.collectNameValues(ch, "SELECT metric, value FROM system.asynchronous_metrics", "ClickHouseAsyncMetrics_",
+		"ClickHouse metric from system.asynchronous_metrics.", prometheus.GaugeValue)
+}
+
+// collectNameValues send a series named prefix+name for every name and value row of query
+func (c *Collector) collectNameValues(ch chan<- prometheus.Metric, query, prefix, help string, valueType prometheus.ValueType) error {
+	rows, err := c.query(query)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if len(row) != 2 {
+			return fmt.Errorf("row %q has %v columns, want 2", row, len(row))
+		}
+		value, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			return fmt.Errorf("value of %v error: %v", row[0], err)
+		}
+
+		name := prefix + invalidNameChar.ReplaceAllString(row[0], "_")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ch <- prometheus.MustNewConstMetric(prometheus.NewDesc(name, help, nil, nil), valueType, value)
+	}
+
+	return nil
+}
+
+func (c *Collector) collectParts(ch chan<- prometheus.Metric) error {
+	rows, err := c.query("SELECT database, table, partition, count(), sum(rows), sum(bytes_on_disk) " +
+		"FROM system.parts WHERE active GROUP BY database, table, partition ORDER BY database, table, partition")
+	if err != nil {
+		return err
+	}
+
+	maxParts := map[[2]string]float64{}
+	for _, row := range rows {
+		if len(row) != 6 {
+			return fmt.Errorf("row %q has %v columns, want 6", row, len(row))
+		}
+		values, err := parseFloats(row[3:])
+		if err != nil {
+			return err
+		}
+		ch <- prometheus.MustNewConstMetric(partsCountDesc, prometheus.GaugeValue, values[0], row[0], row[1], row[2])
+		ch <- prometheus.MustNewConstMetric(partsRowsDesc, prometheus.GaugeValue, values[1], row[0], row[1], row[2])
+		ch <- prometheus.MustNewConstMetric(partsBytesDesc, prometheus.GaugeValue, values[2], row[0], row[1], row[2])
+
+		table := [2]string{row[0], row[1]}
+		if values[0] > maxParts[table] {
+			maxParts[table] = values[0]
+		}
+	}
+	for table, parts := range maxParts {
+		ch <- prometheus.MustNewConstMetric(partsMaxDesc, prometheus.GaugeValue, parts, table[0], table[1])
+	}
+
+	return nil
+}
+
+func (c *Collector) collectReplicas(ch chan<- prometheus.Metric) error {
+	rows, err := c.query("SELECT database, table, " + strings.Join(replicaColumns, ", ") + " FROM system.replicas")
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if len(row) != 2+len(replicaColumns) {
+			return fmt.Errorf("row %q has %v columns, want %v", row, len(row), 2+len(replicaColumns))
+		}
+		values, err := parseFloats(row[2:])
+		if err != nil {
+			return err
+		}
+		for i, column := range replicaColumns {
+			ch <- prometheus.MustNewConstMetric(replicaDescs[column], prometheus.GaugeValue, values[i], row[0], row[1])
+		}
+	}
+
+	return nil
+}
+
+// query run query over the HTTP interface and return the rows of its TabSeparated output
+func (c *Collector) query(query string) ([][]string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+"/?"+url.Values{"query": {query + " FORMAT TabSeparated"}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+	}
+	if c.password != "" {
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return ParseTSV(resp.Body)
+}
+
+// ParseTSV read the rows of the TabSeparated format, unescaping the fields
+func ParseTSV(r io.Reader) ([][]string, error) {
+	rows := [][]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		for i, field := range fields {
+			fields[i] = unescapeTSV(field)
+		}
+		rows = append(rows, fields)
+	}
+
+	return rows, scanner.Err()
+}
+
+func unescapeTSV(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i == len(field)-1 {
+			b.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch field[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(field[i])
+		}
+	}
+
+	return b.String()
+}
+
+func parseFloats(fields []string) ([]float64, error) {
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,130 @@
+package clickhouse_calc
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tables are the TabSeparated answers of the stand-in server by the table a query reads
+var tables = map[string]string{
+	"system.metrics":              "Query\t3\nTCPConnection\t12\n",
+	"system.events":               "Query\t1024\nFailedQuery\t2\n",
+	"system.asynchronous_metrics": "jemalloc.resident\t1048576\nUptime\t3600\n",
+	"system.parts": "default\tevents\t202401\t3\t1000\t4096\n" +
+		"default\tevents\t202402\t7\t2000\t8192\n" +
+		"default\tlogs\t(\\'a\\',1)\t1\t10\t64\n",
+	"system.replicas": "default\tevents\t0\t0\t42\t5\t3\t2\t2\t1\n",
+}
+
+func newServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ClickHouse-User") != "monitor" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "Code: 516. DB::Exception: monitor: Authentication failed")
+			return
+		}
+		query := r.URL.Query().Get("query")
+		if !strings.HasSuffix(query, "FORMAT TabSeparated") {
+			t.Errorf("query %q is not TabSeparated", query)
+		}
+		for table, answer := range tables {
+			if strings.Contains(query, "FROM "+table+" ") {
+				io.WriteString(w, answer)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Code: 60. DB::Exception: Table does not exist")
+	}))
+}
+
+// gather the collector into family name and label values, sorted by label name, to value
+func gather(t *testing.T, c *Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			key := mf.GetName()
+			for _, l := range m.Label {
+				key += "," + l.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				result[key] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				result[key] = m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	return result
+}
+
+func TestCollector(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	server := newServer(t)
+	defer server.Close()
+
+	values := gather(t, NewCollector(setting.ClickhouseS{URL: server.URL, User: "monitor", Password: "secret"}))
+
+	for key, want := range map[string]float64{
+		"ClickHouseMetrics_TCPConnection":                          12,
+		"ClickHouseProfileEvents_Query":                            1024,
+		"ClickHouseAsyncMetrics_jemalloc_resident":                 1048576,
+		"ClickHouseParts_count,default,202402,events":              7,
+		"ClickHouseParts_rows,default,202401,events":               1000,
+		"ClickHouseParts_count,default,('a',1),logs":               1,
+		"ClickHouseParts_max_per_partition,default,events":         7,
+		"ClickHouseReplicas_absolute_delay_seconds,default,events": 42,
+		"ClickHouseReplicas_active_replicas,default,events":        1,
+		"clickhouse_scrape_collector_success,replicas":             1,
+	} {
+		got, ok := values[key]
+		if !ok {
+			t.Errorf("%v is missing", key)
+		} else if got != want {
+			t.Errorf("%v = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestCollectorError(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	server := newServer(t)
+	defer server.Close()
+
+	values := gather(t, NewCollector(setting.ClickhouseS{URL: server.URL, User: "monitor", Password: "wrong"}))
+	for _, table := range []string{"metrics", "events", "asynchronous_metrics", "parts", "replicas"} {
+		if values["clickhouse_scrape_collector_success,"+table] != 0 {
+			t.Errorf("%v succeeded with a wrong password", table)
+		}
+	}
+	if _, ok := values["ClickHouseMetrics_Query"]; ok {
+		t.Error("metrics of a failed query")
+	}
+}
+
+func TestParseTSV(t *testing.T) {
+	rows, err := ParseTSV(strings.NewReader("a\\tb\tc\\\\d\te\\nf\n\nx\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0][0] != "a\tb" || rows[0][1] != `c\d` || rows[0][2] != "e\nf" || len(rows[1]) != 2 || rows[1][1] != "" {
+		t.Errorf("rows = %q", rows)
+	}
+}
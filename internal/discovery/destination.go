@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"net/url"
+	"sync"
+)
+
+const (
+	// ModeFanout sends to every destination
+	ModeFanout = "fanout"
+	// ModeFailover sends to the destinations in order until one accepts
+	ModeFailover = "failover"
+)
+
+// Destinations are the static destinations of a sink followed by the addresses its
+// destination_sd resolves to
+type Destinations struct {
+	static      []string
+	scheme      string
+	path        string
+	mode        string
+	discoveries []*DNSDiscovery
+
+	once sync.Once
+}
+
+// NewDestinations return the Destinations of static and s, mode is used when s sets none.
+// The names are resolved on the first List
+func NewDestinations(static []string, s setting.DestinationSDS, mode string, resolver Resolver) (*Destinations, error) {
+	d := &Destinations{static: static, scheme: s.Scheme, path: s.Path, mode: s.Mode}
+	if d.scheme == "" {
+		d.scheme = "http"
+	}
+	if d.scheme != "http" && d.scheme != "https" {
+		return nil, fmt.Errorf("destination_sd scheme %q is not http or https", s.Scheme)
+	}
+	if d.mode == "" {
+		d.mode = mode
+	}
+	if d.mode != ModeFanout && d.mode != ModeFailover {
+		return nil, fmt.Errorf("destination_sd mode %q is not %v or %v", s.Mode, ModeFanout, ModeFailover)
+	}
+
+	for _, sd := range s.DNSSDConfigs {
+		discovery, err := NewDNSDiscovery(sd, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("destination_sd %v", err)
+		}
+		d.discoveries = append(d.discoveries, discovery)
+	}
+	if len(d.static) == 0 && len(d.discoveries) == 0 {
+		return nil, fmt.Errorf("destination is nil")
+	}
+
+	return d, nil
+}
+
+// Mode return fanout or failover
+func (d *Destinations) Mode() string {
+	return d.mode
+}
+
+// List return the static destinations and the resolved ones without duplicates. The first call
+// resolves the names and keeps them resolved in the background
+func (d *Destinations) List() []string {
+	d.once.Do(func() {
+		for _, discovery := range d.discoveries {
+			discovery.Refresh()
+			go discovery.Run(nil)
+		}
+	})
+
+	result := []string{}
+	seen := map[string]bool{}
+	add := func(dest string) {
+		if !seen[dest] {
+			seen[dest] = true
+			result = append(result, dest)
+		}
+	}
+
+	for _, dest := range d.static {
+		add(dest)
+	}
+	for _, discovery := range d.discoveries {
+		for _, group := range discovery.Groups() {
+			for _, target := range group.Targets {
+				u := url.URL{Scheme: d.scheme, Host: target, Path: d.path}
+				add(u.String())
+			}
+		}
+	}
+
+	return result
+}
+
+// Send call send with the destinations: all of them at once in fanout mode, failing when one
+// fails, or one after another in failover mode until one succeeds
+func (d *Destinations) Send(send func(numb int, dest string) error) error {
+	list := d.List()
+	if len(list) == 0 {
+		return fmt.Errorf("there is no destination")
+	}
+
+	if d.mode == ModeFailover {
+		var errs []error
+		for numb, dest := range list {
+			err := send(numb, dest)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return fmt.Errorf("all %v destinations failed: %v", len(list), errs)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for numb, dest := range list {
+		wg.Add(1)
+		go func(numb int, dest string) {
+			defer wg.Done()
+			defer util.CatchException(func(e interface{}) {
+				global.LogObj.Panic(e)
+			})
+
+			if err := send(numb, dest); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(numb, dest)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v of %v destinations failed: %v", len(errs), len(list), errs)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package discovery
+
+// Discoverer finds target groups. Refresh reads them once, Run keeps them up to date until
+// stop is closed, and Groups return the groups of the last successful reads
+type Discoverer interface {
+	Refresh()
+	Run(stop <-chan struct{})
+	Groups() []Group
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+
+	return result
+}
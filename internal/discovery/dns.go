@@ -0,0 +1,161 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDNSRefreshInterval is how often the names are resolved again
+const DefaultDNSRefreshInterval = 30 * time.Second
+
+const dnsTimeout = 10 * time.Second
+
+// Resolver looks up the records of a name, net.DefaultResolver is one
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSDiscovery resolves names to target groups like Prometheus dns_sd_configs, one group per
+// record with __meta_dns_name, and for SRV records __meta_dns_srv_record_target and
+// __meta_dns_srv_record_port. A name that fails to resolve keeps the groups it had
+type DNSDiscovery struct {
+	names    []string
+	qtype    string
+	port     int
+	refresh  time.Duration
+	resolver Resolver
+
+	mu     sync.RWMutex
+	groups map[string][]Group
+}
+
+// NewDNSDiscovery return a DNSDiscovery of s using resolver, net.DefaultResolver when it is nil
+func NewDNSDiscovery(s setting.DNSSDConfigS, resolver Resolver) (*DNSDiscovery, error) {
+	if len(s.Names) == 0 {
+		return nil, fmt.Errorf("dns_sd_configs has no names")
+	}
+
+	qtype := strings.ToUpper(s.Type)
+	switch qtype {
+	case "":
+		qtype = "SRV"
+	case "SRV":
+	case "A", "AAAA":
+		if s.Port <= 0 {
+			return nil, fmt.Errorf("dns_sd_configs of type %v needs a port", qtype)
+		}
+	default:
+		return nil, fmt.Errorf("dns_sd_configs type %q is not SRV, A or AAAA", s.Type)
+	}
+
+	refresh := s.RefreshInterval
+	if refresh <= 0 {
+		refresh = DefaultDNSRefreshInterval
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &DNSDiscovery{names: s.Names, qtype: qtype, port: s.Port, refresh: refresh, resolver: resolver,
+		groups: map[string][]Group{}}, nil
+}
+
+// Refresh resolve every name
+func (d *DNSDiscovery) Refresh() {
+	for _, name := range d.names {
+		groups, err := d.lookup(name)
+		if err != nil {
+			global.LogObj.Errorf("dns_sd_configs lookup %v %v error: %v", d.qtype, name, err)
+			continue
+		}
+
+		d.mu.Lock()
+		d.groups[name] = groups
+		d.mu.Unlock()
+	}
+}
+
+func (d *DNSDiscovery) lookup(name string) ([]Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	groups := []Group{}
+	if d.qtype == "SRV" {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			port := strconv.Itoa(int(record.Port))
+			groups = append(groups, Group{
+				Targets: []string{net.JoinHostPort(target, port)},
+				Labels: map[string]string{
+					"__meta_dns_name":              name,
+					"__meta_dns_srv_record_target": record.Target,
+					"__meta_dns_srv_record_port":   port,
+				},
+				Source: name,
+			})
+		}
+		return groups, nil
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) != (d.qtype == "A") {
+			continue
+		}
+		groups = append(groups, Group{
+			Targets: []string{net.JoinHostPort(addr.IP.String(), strconv.Itoa(d.port))},
+			Labels:  map[string]string{"__meta_dns_name": name},
+			Source:  name,
+		})
+	}
+
+	return groups, nil
+}
+
+// Groups return the groups of all names in config order
+func (d *DNSDiscovery) Groups() []Group {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	result := []Group{}
+	for _, name := range d.names {
+		result = append(result, d.groups[name]...)
+	}
+
+	return result
+}
+
+// Run resolve the names every refresh interval until stop is closed
+func (d *DNSDiscovery) Run(stop <-chan struct{}) {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	ticker := time.NewTicker(d.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Refresh()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeResolver answers from its records instead of DNS, a name without records fails
+type fakeResolver struct {
+	mu    sync.Mutex
+	srv   map[string][]*net.SRV
+	addrs map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such host %v", name)
+	}
+	return name, records, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %v", host)
+	}
+	return addrs, nil
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_ck._tcp.example.com": {
+				{Target: "ck1.example.com.", Port: 9363},
+				{Target: "ck2.example.com.", Port: 9363},
+			},
+		},
+		addrs: map[string][]net.IPAddr{
+			"ck.example.com": {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::1")}},
+		},
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	resolver := newFakeResolver()
+
+	d, err := NewDNSDiscovery(setting.DNSSDConfigS{Names: []string{"_ck._tcp.example.com"}}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Refresh()
+
+	groups := d.Groups()
+	if len(groups) != 2 || groups[0].Targets[0] != "ck1.example.com:9363" || groups[1].Targets[0] != "ck2.example.com:9363" {
+		t.Fatalf("groups = %+v", groups)
+	}
+	want := map[string]string{
+		"__meta_dns_name":              "_ck._tcp.example.com",
+		"__meta_dns_srv_record_target": "ck1.example.com.",
+		"__meta_dns_srv_record_port":   "9363",
+	}
+	for k, v := range want {
+		if groups[0].Labels[k] != v {
+			t.Errorf("label %v = %q, want %q", k, groups[0].Labels[k], v)
+		}
+	}
+
+	// a failed lookup keeps the last records
+	resolver.mu.Lock()
+	delete(resolver.srv, "_ck._tcp.example.com")
+	resolver.mu.Unlock()
+	d.Refresh()
+	if len(d.Groups()) != 2 {
+		t.Errorf("groups = %+v, want the previous 2 groups", d.Groups())
+	}
+}
+
+func TestDNSDiscoveryA(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	for qtype, want := range map[string]string{"A": "10.0.0.1:8123", "AAAA": "[fd00::1]:8123"} {
+		d, err := NewDNSDiscovery(setting.DNSSDConfigS{Names: []string{"ck.example.com"}, Type: qtype, Port: 8123}, newFakeResolver())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Refresh()
+
+		groups := d.Groups()
+		if len(groups) != 1 || groups[0].Targets[0] != want || groups[0].Labels["__meta_dns_name"] != "ck.example.com" {
+			t.Errorf("%v groups = %+v, want %v", qtype, groups, want)
+		}
+	}
+}
+
+func TestNewDNSDiscoveryError(t *testing.T) {
+	for _, s := range []setting.DNSSDConfigS{
+		{},
+		{Names: []string{"a"}, Type: "MX"},
+		{Names: []string{"a"}, Type: "A"},
+	} {
+		if _, err := NewDNSDiscovery(s, nil); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	d, err := NewDestinations([]string{"http://static:9091"}, setting.DestinationSDS{
+		DNSSDConfigs: []setting.DNSSDConfigS{{Names: []string{"_ck._tcp.example.com"}}},
+		Path:         "/api/v1/write",
+	}, ModeFailover, newFakeResolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := d.List()
+	want := []string{"http://static:9091", "http://ck1.example.com:9363/api/v1/write", "http://ck2.example.com:9363/api/v1/write"}
+	if fmt.Sprint(list) != fmt.Sprint(want) {
+		t.Fatalf("list = %v, want %v", list, want)
+	}
+
+	// failover stops at the first destination that accepts
+	var tried []string
+	err = d.Send(func(numb int, dest string) error {
+		tried = append(tried, dest)
+		if numb == 0 {
+			return fmt.Errorf("down")
+		}
+		return nil
+	})
+	if err != nil || len(tried) != 2 {
+		t.Errorf("failover tried %v, error %v", tried, err)
+	}
+
+	// fanout sends to all and fails when one fails
+	d.mode = ModeFanout
+	var mu sync.Mutex
+	sent := 0
+	err = d.Send(func(numb int, dest string) error {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		if numb == 2 {
+			return fmt.Errorf("down")
+		}
+		return nil
+	})
+	if err == nil || sent != 3 {
+		t.Errorf("fanout sent %v, error %v", sent, err)
+	}
+}
+
+func TestNewDestinationsError(t *testing.T) {
+	for _, s := range []setting.DestinationSDS{
+		{},
+		{Mode: "roundrobin", DNSSDConfigs: []setting.DNSSDConfigS{{Names: []string{"a"}}}},
+		{Scheme: "ftp", DNSSDConfigs: []setting.DNSSDConfigS{{Names: []string{"a"}}}},
+		{DNSSDConfigs: []setting.DNSSDConfigS{{Names: []string{"a"}, Type: "AAAA"}}},
+	} {
+		if _, err := NewDestinations(nil, s, ModeFanout, nil); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
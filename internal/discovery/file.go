@@ -0,0 +1,207 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshInterval is how often the files are read again when no change was noticed
+const DefaultRefreshInterval = 5 * time.Minute
+
+// patternRegex matches the file patterns Prometheus accepts, a glob is only allowed in the last element
+var patternRegex = regexp.MustCompile(`^[^*]*(\*[^/]*)?\.(json|yml|yaml|JSON|YML|YAML)$`)
+
+// Group is a target group of a file in the format of Prometheus file_sd_configs
+type Group struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+	Source  string            `json:"-" yaml:"-"` // path of the file the group was read from
+}
+
+// FileDiscovery keeps the target groups of the files matching its patterns up to date, with
+// __meta_filepath set to the file of the group. A file that can not be read or parsed keeps
+// the groups it had, a removed file loses them
+type FileDiscovery struct {
+	patterns []string
+	refresh  time.Duration
+
+	mu     sync.RWMutex
+	groups map[string][]Group
+}
+
+// NewFileDiscovery return a FileDiscovery of s, its groups are empty until Refresh or Run
+func NewFileDiscovery(s setting.FileSDConfigS) (*FileDiscovery, error) {
+	if len(s.Files) == 0 {
+		return nil, fmt.Errorf("file_sd_configs has no files")
+	}
+	for _, pattern := range s.Files {
+		if !patternRegex.MatchString(pattern) {
+			return nil, fmt.Errorf("file_sd_configs path %q is not a valid json or yaml file pattern", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("file_sd_configs path %q error: %v", pattern, err)
+		}
+	}
+
+	refresh := s.RefreshInterval
+	if refresh <= 0 {
+		refresh = DefaultRefreshInterval
+	}
+
+	return &FileDiscovery{patterns: s.Files, refresh: refresh, groups: map[string][]Group{}}, nil
+}
+
+// Refresh read every file matching the patterns
+func (d *FileDiscovery) Refresh() {
+	paths := map[string]bool{}
+	for _, pattern := range d.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			global.LogObj.Errorf("file_sd_configs glob %v error: %v", pattern, err)
+			continue
+		}
+		for _, path := range matches {
+			paths[path] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	groups := make(map[string][]Group, len(paths))
+	for path := range paths {
+		read, err := ReadGroups(path)
+		if err != nil {
+			global.LogObj.Errorf("file_sd_configs read %v error: %v", path, err)
+			if last, ok := d.groups[path]; ok {
+				groups[path] = last
+			}
+			continue
+		}
+		for i := range read {
+			read[i].Labels = copyLabels(read[i].Labels)
+			read[i].Labels["__meta_filepath"] = path
+		}
+		groups[path] = read
+	}
+	d.groups = groups
+}
+
+// Groups return the groups of all files ordered by file
+func (d *FileDiscovery) Groups() []Group {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	paths := make([]string, 0, len(d.groups))
+	for path := range d.groups {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	result := []Group{}
+	for _, path := range paths {
+		result = append(result, d.groups[path]...)
+	}
+
+	return result
+}
+
+// Run refresh the groups whenever a file in the directories of the patterns changes, and every
+// refresh interval in case a change was missed, until stop is closed
+func (d *FileDiscovery) Run(stop <-chan struct{}) {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		global.LogObj.Errorf("file_sd_configs watch error: %v, reading the files every %v only", err, d.refresh)
+	} else {
+		defer watcher.Close()
+		dirs := map[string]bool{}
+		for _, pattern := range d.patterns {
+			dirs[filepath.Dir(pattern)] = true
+		}
+		for dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				global.LogObj.Errorf("file_sd_configs watch %v error: %v", dir, err)
+			}
+		}
+	}
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(d.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Refresh()
+		case event := <-events:
+			// editors and rename based writers produce several events for one change
+			if event.Op != fsnotify.Chmod {
+				d.Refresh()
+			}
+		case err := <-errs:
+			global.LogObj.Errorf("file_sd_configs watch error: %v", err)
+		}
+	}
+}
+
+// ReadGroups read the target groups of a json or yaml file, chosen by its extension
+func ReadGroups(path string) ([]Group, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []Group{}
+	switch filepath.Ext(path) {
+	case ".json", ".JSON":
+		err = json.Unmarshal(content, &groups)
+	case ".yml", ".yaml", ".YML", ".YAML":
+		err = yaml.UnmarshalStrict(content, &groups)
+	default:
+		err = fmt.Errorf("unknown file extension %v", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		for _, target := range groups[i].Targets {
+			if target == "" {
+				return nil, fmt.Errorf("group %v has an empty target", i)
+			}
+		}
+		for name := range groups[i].Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("group %v label name %q is not valid", i, name)
+			}
+		}
+		groups[i].Source = path
+	}
+
+	return groups, nil
+}
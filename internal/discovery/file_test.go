@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testJSON = `[{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"env": "prod"}}]`
+
+const testYAML = `
+- targets: ["10.0.0.3:9363"]
+  labels:
+    env: test
+    role: clickhouse
+`
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), testJSON)
+	writeFile(t, filepath.Join(dir, "b.yml"), testYAML)
+	writeFile(t, filepath.Join(dir, "c.txt"), testJSON)
+
+	d, err := NewFileDiscovery(setting.FileSDConfigS{Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Refresh()
+
+	groups := d.Groups()
+	if len(groups) != 2 {
+		t.Fatalf("groups = %+v, want the groups of a.json and b.yml", groups)
+	}
+	if groups[0].Source != filepath.Join(dir, "a.json") || len(groups[0].Targets) != 2 || groups[0].Labels["env"] != "prod" {
+		t.Errorf("group 0 = %+v", groups[0])
+	}
+	if groups[1].Labels["role"] != "clickhouse" {
+		t.Errorf("group 1 = %+v", groups[1])
+	}
+
+	// a broken file keeps its groups, a removed one loses them
+	writeFile(t, filepath.Join(dir, "a.json"), `[{"targets": [`)
+	if err := os.Remove(filepath.Join(dir, "b.yml")); err != nil {
+		t.Fatal(err)
+	}
+	d.Refresh()
+	groups = d.Groups()
+	if len(groups) != 1 || groups[0].Labels["env"] != "prod" {
+		t.Errorf("groups = %+v, want the previous groups of a.json only", groups)
+	}
+}
+
+func TestFileDiscoveryRun(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	dir := t.TempDir()
+
+	d, err := NewFileDiscovery(setting.FileSDConfigS{Files: []string{filepath.Join(dir, "*.json")}, RefreshInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Run(stop)
+
+	// the watcher, not the hourly refresh, has to notice the new file
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.Groups()) == 0 {
+		writeFile(t, filepath.Join(dir, "new.json"), testJSON)
+		if time.Now().After(deadline) {
+			t.Fatal("the new file was not noticed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNewFileDiscoveryError(t *testing.T) {
+	for _, files := range [][]string{
+		nil,
+		{"/etc/targets/*.txt"},
+		{"/etc/*/targets.json"},
+	} {
+		if _, err := NewFileDiscovery(setting.FileSDConfigS{Files: files}); err == nil {
+			t.Errorf("expected an error for %v", files)
+		}
+	}
+}
+
+func TestReadGroupsError(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"label.json":   `[{"targets": ["a:1"], "labels": {"bad-name": "x"}}]`,
+		"empty.json":   `[{"targets": [""]}]`,
+		"unknown.yaml": "- targets: [a:1]\n  extra: 1\n",
+	} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, content)
+		if _, err := ReadGroups(path); err == nil {
+			t.Errorf("expected an error for %v", name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package file_push
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/self_metrics"
+	"github.com/exporterpush/internal/stdout_push"
+	"github.com/exporterpush/pkg/prom2json"
+	promclient "github.com/exporterpush/pkg/prometheus-remote-client"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"github.com/natefinch/lumberjack"
+	"time"
+)
+
+const (
+	FormatText        = "text"         // prometheus text exposition, one batch per blank line separated block
+	FormatNDJSON      = "ndjson"       // one global.MetricPoint json object per line
+	FormatRemoteWrite = "remote_write" // uvarint length delimited prompb.WriteRequest
+
+	fileExt = ".metrics"
+)
+
+func FilePush() {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	intervalTime := time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second
+	ticker := time.NewTicker(intervalTime)
+	defer ticker.Stop()
+
+	w := NewWriter(global.FileSetting)
+	defer w.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+			begin := time.Now()
+			err := writeOnce(w)
+			self_metrics.ObserveCycle("file", begin, err)
+			if err != nil {
+				global.LogObj.Error(err)
+			}
+		}
+	}
+}
+
+// FilePushOnce scrape node_exporter and the sources and append the batch to the file one time
+func FilePushOnce() error {
+	w := NewWriter(global.FileSetting)
+	defer w.Close()
+
+	return writeOnce(w)
+}
+
+func writeOnce(w *Writer) error {
+	metricPointList, err := scrape.SinkMetricPointList(global.FileSetting.Labels)
+	if err != nil {
+		return err
+	}
+
+	if global.DryRun {
+		if err := stdout_push.PrintMetricPointList("file", w.Filename(), global.DryRunFormat, metricPointList); err != nil {
+			return fmt.Errorf("dry-run print file payload error:%v", err)
+		}
+		return nil
+	}
+
+	if err := w.WriteBatch(metricPointList); err != nil {
+		return fmt.Errorf("write metric batch to file %v error:%v", w.Filename(), err)
+	}
+
+	global.LogObj.Infof("write %v metric points to file %v success", len(metricPointList), w.Filename())
+
+	return nil
+}
+
+// Writer appends scrape batches to a rotating file in one of the supported formats
+type Writer struct {
+	format         string
+	rotateInterval time.Duration
+	openedAt       time.Time
+	out            *lumberjack.Logger
+}
+
+// NewWriter return a Writer for the file described by the file sink setting
+func NewWriter(s *setting.FileS) *Writer {
+	return &Writer{
+		format:         s.Format,
+		rotateInterval: time.Duration(s.RotateInterval) * time.Second,
+		openedAt:       time.Now(),
+		out: &lumberjack.Logger{
+			Filename:   currentFile(s.Path, s.FileName),
+			MaxSize:    s.MaxSize,
+			MaxBackups: s.MaxBackups,
+			Compress:   s.Compress,
+		},
+	}
+}
+
+// Filename return the path of the file currently written
+func (w *Writer) Filename() string {
+	return w.out.Filename
+}
+
+// WriteBatch encodes the batch and appends it with a single write, so a size
+// rotation never splits a batch across two files
+func (w *Writer) WriteBatch(metricPointList []global.MetricPoint) error {
+	if len(metricPointList) == 0 {
+		return nil
+	}
+
+	body, err := Encode(w.format, metricPointList)
+	if err != nil {
+		return err
+	}
+
+	if w.rotateInterval > 0 && time.Since(w.openedAt) >= w.rotateInterval {
+		if err := w.out.Rotate(); err != nil {
+			return fmt.Errorf("rotate file %v error: %v", w.out.Filename, err)
+		}
+		w.openedAt = time.Now()
+	}
+
+	_, err = w.out.Write(body)
+	return err
+}
+
+func (w *Writer) Close() error {
+	return w.out.Close()
+}
+
+// Encode convert one scrape batch into the bytes appended to the file
+func Encode(format string, metricPointList []global.MetricPoint) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case FormatText:
+		buf.Write(prom2json.MetricPointListToText(metricPointList))
+		buf.WriteString("\n")
+
+	case FormatNDJSON:
+		enc := json.NewEncoder(buf)
+		for _, point := range metricPointList {
+			if err := enc.Encode(point); err != nil {
+				return nil, err
+			}
+		}
+
+	case FormatRemoteWrite:
+		writeReq, err := promclient.MetricPointList(metricPointList).ToWriteRequest()
+		if err != nil {
+			return nil, err
+		}
+		data, err := writeReq.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+		buf.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(data)))])
+		buf.Write(data)
+
+	default:
+		return nil, fmt.Errorf("unknown file format %q", format)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,145 @@
+package file_push
+
+import (
+	"bytes"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var testPoints = []global.MetricPoint{
+	{Metric: "node_load1", LabelMap: map[string]string{"instance": "a"}, Time: 1650000000, Value: 0.5},
+	{Metric: "node_load1", LabelMap: map[string]string{"instance": "b", "quote": `x"y`}, Time: 1650000000, Value: 1.25},
+	{Metric: "up", LabelMap: map[string]string{}, Time: 1650000015, Value: 1},
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatText, FormatNDJSON, FormatRemoteWrite} {
+		buf := &bytes.Buffer{}
+		for i := 0; i < 2; i++ {
+			body, err := Encode(format, testPoints)
+			if err != nil {
+				t.Fatalf("%v encode error: %v", format, err)
+			}
+			buf.Write(body)
+		}
+
+		samples := 0
+		err := Decode(format, buf, func(writeReq *prompb.WriteRequest) error {
+			for _, ts := range writeReq.Timeseries {
+				for _, s := range ts.Samples {
+					if s.Timestamp != 1650000000000 && s.Timestamp != 1650000015000 {
+						t.Errorf("%v lost the original timestamp: %v", format, s.Timestamp)
+					}
+					samples++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%v decode error: %v", format, err)
+		}
+
+		if samples != 2*len(testPoints) {
+			t.Errorf("%v decoded %v samples, want %v", format, samples, 2*len(testPoints))
+		}
+	}
+}
+
+func TestReplayFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"metrics" + fileExt,
+		"metrics-2022-01-02T00-00-00.000" + fileExt,
+		"metrics-2022-01-01T00-00-00.000" + fileExt + ".gz",
+		// a backup still being compressed
+		"metrics-2022-01-02T00-00-00.000" + fileExt + ".gz",
+		// the files of another sink named metrics-node
+		"metrics-node" + fileExt,
+		"metrics-node-2022-01-01T00-00-00.000" + fileExt,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ReplayFiles(dir, "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"metrics-2022-01-01T00-00-00.000" + fileExt + ".gz",
+		"metrics-2022-01-02T00-00-00.000" + fileExt,
+		"metrics" + fileExt,
+	}
+	if len(files) != len(want) {
+		t.Fatalf("files = %v, want %v", files, want)
+	}
+	for i := range want {
+		if filepath.Base(files[i]) != want[i] {
+			t.Errorf("file %v = %v, want %v", i, filepath.Base(files[i]), want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	dir, err := ioutil.TempDir("", "file_push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an older rotated backup must be replayed before the current file
+	older, _ := Encode(FormatNDJSON, testPoints[:1])
+	if err := ioutil.WriteFile(filepath.Join(dir, "metrics-2022-01-01T00-00-00.000"+fileExt), older, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWriter(&setting.FileS{Path: dir, FileName: "metrics", Format: FormatNDJSON, MaxSize: 1})
+	if err := w.WriteBatch(testPoints[2:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	var mu sync.Mutex
+	received := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeReq := &prompb.WriteRequest{}
+		if err := writeReq.Unmarshal(data); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, ts := range writeReq.Timeseries {
+			received = append(received, ts.Labels[0].Value)
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	if err := Replay(dir, "metrics", FormatNDJSON, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 2 || received[0] != "node_load1" || received[1] != "up" {
+		t.Errorf("replayed out of order: %v", received)
+	}
+}
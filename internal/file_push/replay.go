@@ -0,0 +1,285 @@
+package file_push
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/prom2json"
+	promclient "github.com/exporterpush/pkg/prometheus-remote-client"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ndjsonBatchSize is the number of points sent per remote write request when replaying ndjson files
+const ndjsonBatchSize = 1000
+
+func currentFile(dir, name string) string {
+	return filepath.Join(dir, name+fileExt)
+}
+
+// backupPattern matches the rotated backups lumberjack names <name>-<time><ext>, optionally gzipped,
+// see backupTimeFormat in lumberjack
+const backupPattern = `-\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3}`
+
+// ReplayFiles return the files written by the file sink oldest first: the rotated
+// backups in timestamp order followed by the file currently written. Only the lumberjack
+// timestamp may follow name, so the backups of a sink whose name starts with name- are left out
+func ReplayFiles(dir, name string) ([]string, error) {
+	candidates, err := filepath.Glob(filepath.Join(dir, name+"-*"+fileExt+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	backup := regexp.MustCompile("^" + regexp.QuoteMeta(name) + backupPattern + regexp.QuoteMeta(fileExt) + `(\.gz)?$`)
+	matches := []string{}
+	for _, m := range candidates {
+		if backup.MatchString(filepath.Base(m)) {
+			matches = append(matches, m)
+		}
+	}
+
+	exist := map[string]bool{}
+	for _, m := range matches {
+		exist[m] = true
+	}
+
+	files := []string{}
+	for _, m := range matches {
+		// a backup still being compressed exists twice, read the complete plain one
+		if strings.HasSuffix(m, ".gz") && exist[strings.TrimSuffix(m, ".gz")] {
+			continue
+		}
+		files = append(files, m)
+	}
+	sort.Strings(files)
+
+	if _, err := os.Stat(currentFile(dir, name)); err == nil {
+		files = append(files, currentFile(dir, name))
+	}
+
+	return files, nil
+}
+
+// Replay send every batch found in the file sink files to the remote write url in
+// the order they were written, the original sample timestamps are kept
+func Replay(dir, name, format, url string) error {
+	files, err := ReplayFiles(dir, name)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no %v files found in %v", name, dir)
+	}
+
+	cfg := promclient.NewConfig(promclient.WriteURLOption(url))
+	remoteWriteClient, err := promclient.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("new prometheus remote write client error: %v", err)
+	}
+
+	for _, file := range files {
+		batchCount := 0
+		err := readFile(file, format, func(writeReq *prompb.WriteRequest) error {
+			if len(writeReq.Timeseries) == 0 {
+				return nil
+			}
+
+			if _, writeErr := remoteWriteClient.WriteProto(context.Background(), writeReq, promclient.WriteOptions{}); writeErr != nil {
+				return fmt.Errorf("remote write batch %v to %v error: %v", batchCount, url, writeErr)
+			}
+			batchCount++
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("replay file %v error: %v", file, err)
+		}
+
+		global.LogObj.Infof("replay %v batches of file %v to %v success", batchCount, file, url)
+	}
+
+	return nil
+}
+
+func readFile(file, format string, fn func(*prompb.WriteRequest) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	return Decode(format, in, fn)
+}
+
+// Decode read the batches written by Encode and hands them to fn one by one
+func Decode(format string, in io.Reader, fn func(*prompb.WriteRequest) error) error {
+	switch format {
+	case FormatText:
+		return decodeText(in, fn)
+	case FormatNDJSON:
+		return decodeNDJSON(in, fn)
+	case FormatRemoteWrite:
+		return decodeRemoteWrite(in, fn)
+	}
+
+	return fmt.Errorf("unknown file format %q", format)
+}
+
+func decodeText(in io.Reader, fn func(*prompb.WriteRequest) error) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	block := &bytes.Buffer{}
+	flush := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		defer block.Reset()
+
+		metricPointList, err := parseTextBlock(block)
+		if err != nil {
+			return err
+		}
+
+		return sendMetricPointList(metricPointList, fn)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		block.Write(line)
+		block.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// parseTextBlock parse one text batch keeping the timestamp written with every sample
+func parseTextBlock(block io.Reader) ([]global.MetricPoint, error) {
+	mfChan := make(chan *dto.MetricFamily, 1024)
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- prom2json.ParseReader(block, mfChan)
+	}()
+
+	metricPointList := []global.MetricPoint{}
+	for mf := range mfChan {
+		for _, m := range mf.Metric {
+			labelMap := map[string]string{}
+			for _, lp := range m.Label {
+				labelMap[lp.GetName()] = lp.GetValue()
+			}
+
+			metricPointList = append(metricPointList, global.MetricPoint{
+				Metric:   mf.GetName(),
+				LabelMap: labelMap,
+				Time:     m.GetTimestampMs() / 1000,
+				Value:    m.GetUntyped().GetValue(),
+			})
+		}
+	}
+
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
+	return metricPointList, nil
+}
+
+func decodeNDJSON(in io.Reader, fn func(*prompb.WriteRequest) error) error {
+	dec := json.NewDecoder(in)
+
+	metricPointList := []global.MetricPoint{}
+	for {
+		point := global.MetricPoint{}
+		err := dec.Decode(&point)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		metricPointList = append(metricPointList, point)
+		if len(metricPointList) >= ndjsonBatchSize {
+			if err := sendMetricPointList(metricPointList, fn); err != nil {
+				return err
+			}
+			metricPointList = []global.MetricPoint{}
+		}
+	}
+
+	return sendMetricPointList(metricPointList, fn)
+}
+
+func decodeRemoteWrite(in io.Reader, fn func(*prompb.WriteRequest) error) error {
+	r := bufio.NewReader(in)
+
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("read truncated remote write batch: %v", err)
+		}
+
+		writeReq := &prompb.WriteRequest{}
+		if err := writeReq.Unmarshal(data); err != nil {
+			return err
+		}
+
+		if err := fn(writeReq); err != nil {
+			return err
+		}
+	}
+}
+
+func sendMetricPointList(metricPointList []global.MetricPoint, fn func(*prompb.WriteRequest) error) error {
+	if len(metricPointList) == 0 {
+		return nil
+	}
+
+	writeReq, err := promclient.MetricPointList(metricPointList).ToWriteRequest()
+	if err != nil {
+		return err
+	}
+
+	return fn(writeReq)
+}
@@ -0,0 +1,288 @@
+package http_json_push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/self_metrics"
+	"github.com/exporterpush/internal/stdout_push"
+	"github.com/exporterpush/pkg/hostfacts"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Presets are the request settings of known receivers, ApplyPreset copies them into the unset fields
+var Presets = map[string]setting.HttpJsonS{
+	"barad": {
+		Method:  "POST",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Success: setting.HttpJsonSuccess{
+			StatusCodes: []int{200},
+			BodyField:   "code",
+			BodyValues:  []string{"0"},
+		},
+	},
+}
+
+// ApplyPreset fill the unset method, headers and success condition of s from its preset,
+// then the remaining defaults
+func ApplyPreset(s *setting.HttpJsonS) error {
+	if s.Preset != "" {
+		preset, ok := Presets[s.Preset]
+		if !ok {
+			return fmt.Errorf("http_json %v unknown preset %q", s.Name, s.Preset)
+		}
+
+		if s.Method == "" {
+			s.Method = preset.Method
+		}
+		for k, v := range preset.Headers {
+			if s.Headers == nil {
+				s.Headers = map[string]string{}
+			}
+			if _, ok := s.Headers[strings.ToLower(k)]; !ok {
+				s.Headers[strings.ToLower(k)] = v
+			}
+		}
+		if len(s.Success.StatusCodes) == 0 {
+			s.Success.StatusCodes = preset.Success.StatusCodes
+		}
+		if s.Success.BodyField == "" {
+			s.Success.BodyField = preset.Success.BodyField
+			s.Success.BodyValues = preset.Success.BodyValues
+		}
+	}
+
+	if s.Method == "" {
+		s.Method = "POST"
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = 10
+	}
+	if s.RetryBackoff <= 0 {
+		s.RetryBackoff = 1000
+	}
+
+	return nil
+}
+
+// Encoder render the request body of a batch of points from the template or the mapping of the sink
+type Encoder struct {
+	tmpl    *template.Template
+	mapping map[string]string
+	root    string
+	labels  map[string]string
+}
+
+// templateData is what the body template is executed against
+type templateData struct {
+	Points      []global.MetricPoint
+	Timestamp   int64
+	Labels      map[string]string
+	Destination string
+}
+
+// NewEncoder parse the body template of s, a sink without a template uses its mapping
+func NewEncoder(s *setting.HttpJsonS) (*Encoder, error) {
+	e := &Encoder{mapping: s.Mapping, root: s.MappingRoot}
+	if len(s.StaticConfigs) > 0 {
+		e.labels = s.StaticConfigs[0].Labels
+	}
+
+	if s.Template == "" {
+		if len(s.Mapping) == 0 {
+			return nil, fmt.Errorf("http_json %v needs a template or a mapping", s.Name)
+		}
+		return e, nil
+	}
+
+	funcs := hostfacts.FuncMap(e.labels)
+	funcs["json"] = func(v interface{}) (string, error) {
+		body, err := json.Marshal(v)
+		return string(body), err
+	}
+
+	tmpl, err := template.New(s.Name).Funcs(funcs).Parse(s.Template)
+	if err != nil {
+		return nil, fmt.Errorf("parse http_json %v template error: %v", s.Name, err)
+	}
+	e.tmpl = tmpl
+
+	return e, nil
+}
+
+// Encode render the body of points, the result must be valid json
+func (e *Encoder) Encode(points []global.MetricPoint, dest string) ([]byte, error) {
+	var body []byte
+
+	if e.tmpl != nil {
+		buf := &bytes.Buffer{}
+		err := e.tmpl.Execute(buf, templateData{
+			Points:      points,
+			Timestamp:   time.Now().Unix(),
+			Labels:      e.labels,
+			Destination: dest,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("execute template error: %v", err)
+		}
+		body = buf.Bytes()
+	} else {
+		items := make([]map[string]interface{}, 0, len(points))
+		for _, point := range points {
+			item, err := e.mapPoint(point)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		var v interface{} = items
+		if e.root != "" {
+			v = map[string]interface{}{e.root: items}
+		}
+
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("rendered body is not valid json: %v", string(body))
+	}
+
+	return body, nil
+}
+
+// mapPoint build the json object of one point, the mapping values $metric, $value, $time,
+// $labels and $label.<name> take the field of the point, any other value is rendered as a
+// hostfacts template against the point labels
+func (e *Encoder) mapPoint(point global.MetricPoint) (map[string]interface{}, error) {
+	item := make(map[string]interface{}, len(e.mapping))
+
+	for key, field := range e.mapping {
+		switch {
+		case field == "$metric":
+			item[key] = point.Metric
+		case field == "$value":
+			item[key] = point.Value
+		case field == "$time":
+			item[key] = point.Time
+		case field == "$labels":
+			item[key] = point.LabelMap
+		case strings.HasPrefix(field, "$label."):
+			item[key] = point.LabelMap[strings.TrimPrefix(field, "$label.")]
+		default:
+			value, err := hostfacts.Render(field, point.LabelMap)
+			if err != nil {
+				return nil, err
+			}
+			item[key] = value
+		}
+	}
+
+	return item, nil
+}
+
+// batches split points into chunks of size, all points are one chunk when size is not positive
+func batches(points []global.MetricPoint, size int) [][]global.MetricPoint {
+	if size <= 0 || len(points) <= size {
+		return [][]global.MetricPoint{points}
+	}
+
+	result := [][]global.MetricPoint{}
+	for start := 0; start < len(points); start += size {
+		end := start + size
+		if end > len(points) {
+			end = len(points)
+		}
+		result = append(result, points[start:end])
+	}
+
+	return result
+}
+
+// HttpJsonPush return the run and once functions of the sink s
+func HttpJsonPush(s *setting.HttpJsonS) (func(), func() error) {
+	sender := NewSender(s)
+	encoder, err := NewEncoder(s)
+
+	once := func() error {
+		if err != nil {
+			return err
+		}
+		return pushOnce(s, encoder, sender)
+	}
+
+	run := func() {
+		defer util.CatchException(func(e interface{}) {
+			global.LogObj.Panic(e)
+		})
+
+		intervalTime := time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second
+		ticker := time.NewTicker(intervalTime)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				begin := time.Now()
+				err := once()
+				self_metrics.ObserveCycle("http_json/"+s.Name, begin, err)
+				if err != nil {
+					global.LogObj.Error(err)
+				}
+			}
+		}
+	}
+
+	return run, once
+}
+
+// pushOnce scrape node_exporter and the sources and send the points in batches
+func pushOnce(s *setting.HttpJsonS, encoder *Encoder, sender *Sender) error {
+	metricPointList, err := scrape.SinkMetricPointList(encoder.labels)
+	if err != nil {
+		return err
+	}
+
+	dest := ""
+	if len(sender.destinations) > 0 {
+		dest = sender.destinations[0]
+	}
+
+	// a failed batch is spooled by the sender, the later batches are still sent
+	var errs []error
+	for _, batch := range batches(metricPointList, s.BatchSize) {
+		body, err := encoder.Encode(batch, dest)
+		if err != nil {
+			return fmt.Errorf("render http_json %v body error:%v", s.Name, err)
+		}
+
+		if global.DryRun {
+			if err := stdout_push.PrintJSON("http_json/"+s.Name, dest, body); err != nil {
+				return fmt.Errorf("dry-run print http_json %v payload error:%v", s.Name, err)
+			}
+			continue
+		}
+
+		if err := sender.Send(body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	if !global.DryRun {
+		global.LogObj.Infof("http_json %v push success, points:%v", s.Name, len(metricPointList))
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package http_json_push
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"strings"
+	"testing"
+)
+
+var testPoints = []global.MetricPoint{
+	{Metric: "node_load1", LabelMap: map[string]string{"instance": "a"}, Time: 1650000000, Value: 0.5},
+	{Metric: "node_load5", LabelMap: map[string]string{"instance": "a"}, Time: 1650000000, Value: 1},
+	{Metric: "node_load15", LabelMap: map[string]string{"instance": "a"}, Time: 1650000000, Value: 2},
+}
+
+const testConfig = `
+http_json:
+  - name: templated
+    preset: barad
+    batch_size: 2
+    template: '{"host":"{{label "host"}}","batch":[{{range $i, $p := .Points}}{{if $i}},{{end}}{"name":{{json $p.Metric}},"value":{{$p.Value}}}{{end}}]}'
+    static_configs:
+      - destination: [http://127.0.0.1:1/a]
+        labels:
+          host: h1
+  - name: mapped
+    mapping:
+      name: $metric
+      v: $value
+      ts: $time
+      ins: $label.instance
+      k: x-{{label "instance"}}
+    mapping_root: data
+`
+
+func readTestConfig(t *testing.T) []setting.HttpJsonS {
+	vp, err := setting.NewSettingFromReader(strings.NewReader(testConfig), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinks := []setting.HttpJsonS{}
+	if err := vp.ReadSection("http_json", &sinks); err != nil {
+		t.Fatal(err)
+	}
+	for i := range sinks {
+		if err := ApplyPreset(&sinks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return sinks
+}
+
+func TestEncoder(t *testing.T) {
+	sinks := readTestConfig(t)
+
+	want := map[string]string{
+		"templated": `{"host":"h1","batch":[{"name":"node_load1","value":0.5},{"name":"node_load5","value":1}]}`,
+		"mapped": `{"data":[{"ins":"a","k":"x-a","name":"node_load1","ts":1650000000,"v":0.5},` +
+			`{"ins":"a","k":"x-a","name":"node_load5","ts":1650000000,"v":1}]}`,
+	}
+
+	for i := range sinks {
+		encoder, err := NewEncoder(&sinks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := encoder.Encode(testPoints[:2], "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want[sinks[i].Name] {
+			t.Errorf("%v body = %s, want %s", sinks[i].Name, body, want[sinks[i].Name])
+		}
+	}
+
+	broken := setting.HttpJsonS{Name: "broken", Template: `{"value":{{range .Points}}{{.Value}},{{end}}}`}
+	encoder, err := NewEncoder(&broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Encode(testPoints, ""); err == nil {
+		t.Error("expected an error for a body that is not json")
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	sinks := readTestConfig(t)
+
+	barad := sinks[0]
+	if barad.Method != "POST" || barad.Headers["content-type"] != "application/json" {
+		t.Errorf("barad preset request = %v %v", barad.Method, barad.Headers)
+	}
+	if barad.Success.BodyField != "code" || len(barad.Success.StatusCodes) != 1 {
+		t.Errorf("barad preset success = %+v", barad.Success)
+	}
+
+	if got := batches(testPoints, barad.BatchSize); len(got) != 2 || len(got[1]) != 1 {
+		t.Errorf("batches of 2 = %v", got)
+	}
+
+	if err := ApplyPreset(&setting.HttpJsonS{Preset: "nope"}); err == nil {
+		t.Error("expected an error for an unknown preset")
+	}
+}
@@ -0,0 +1,305 @@
+package http_json_push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender sends json request bodies with a timeout, retries with exponential backoff and
+// fails over across all destinations, starting from the one that worked last. A body that
+// still can not be delivered is buffered in the spool directory and resent oldest first
+// once a destination accepts requests again
+type Sender struct {
+	name         string
+	client       *http.Client
+	method       string
+	headers      map[string]string
+	success      setting.HttpJsonSuccess
+	destinations []string
+	retries      int
+	backoff      time.Duration
+	spoolDir     string
+	spoolMax     int
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewSender return the Sender for the http_json setting, whose preset is already applied
+func NewSender(s *setting.HttpJsonS) *Sender {
+	destinations := []string{}
+	for _, staticConfig := range s.StaticConfigs {
+		destinations = append(destinations, staticConfig.Destination...)
+	}
+
+	return &Sender{
+		name:         s.Name,
+		client:       &http.Client{Timeout: time.Duration(s.Timeout) * time.Second},
+		method:       s.Method,
+		headers:      s.Headers,
+		success:      s.Success,
+		destinations: destinations,
+		retries:      s.Retries,
+		backoff:      time.Duration(s.RetryBackoff) * time.Millisecond,
+		spoolDir:     s.SpoolDir,
+		spoolMax:     s.SpoolMaxFiles,
+	}
+}
+
+// rejectedError is a 4xx answer or a response whose body fails success.body_field, the
+// destination will never accept the body so it is not retried nor spooled
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+// Send deliver body, spooling it when every attempt failed. The spooled bodies are
+// resent first so barad receives the batches in order. A rejected body is moved to the
+// rejected directory of the spool instead
+func (s *Sender) Send(body []byte) error {
+	if err := s.Flush(); err != nil {
+		if spoolErr := s.spool(body); spoolErr != nil {
+			return fmt.Errorf("%v, spool error: %v", err, spoolErr)
+		}
+		return fmt.Errorf("%v spool not flushed, batch buffered: %v", s.name, err)
+	}
+
+	if err := s.deliver(body); err != nil {
+		if _, ok := err.(*rejectedError); ok {
+			return s.quarantine(body, err)
+		}
+		if spoolErr := s.spool(body); spoolErr != nil {
+			return fmt.Errorf("%v, spool error: %v", err, spoolErr)
+		}
+		return fmt.Errorf("%v, batch buffered in %v", err, s.spoolDir)
+	}
+
+	return nil
+}
+
+// Flush resend the spooled bodies oldest first, stopping at the first one that still fails.
+// A rejected body is moved aside so it does not block the ones after it
+func (s *Sender) Flush() error {
+	files, err := s.spooled()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		if err := s.deliver(body); err != nil {
+			if _, ok := err.(*rejectedError); !ok {
+				return err
+			}
+			global.LogObj.Error(s.quarantine(body, err))
+		}
+
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliver try every destination, retrying the whole list with backoff. When every
+// destination rejected the body the rejection is returned without retrying
+func (s *Sender) deliver(body []byte) error {
+	if len(s.destinations) == 0 {
+		return fmt.Errorf("%v destination is nil", s.name)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.backoff * time.Duration(1<<uint(attempt-1)))
+		}
+
+		s.mu.Lock()
+		start := s.next
+		s.mu.Unlock()
+
+		rejected := 0
+		for i := 0; i < len(s.destinations); i++ {
+			idx := (start + i) % len(s.destinations)
+			if lastErr = s.post(s.destinations[idx], body); lastErr == nil {
+				s.mu.Lock()
+				s.next = idx
+				s.mu.Unlock()
+				return nil
+			}
+			if _, ok := lastErr.(*rejectedError); ok {
+				rejected++
+			}
+		}
+		if rejected == len(s.destinations) {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+func (s *Sender) post(dest string, body []byte) error {
+	req, err := http.NewRequest(s.method, dest, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("init %v request error:%v", s.name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	response, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request %v error:%v", dest, err)
+	}
+	defer response.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(response.Body)
+	if !s.statusOK(response.StatusCode) {
+		err := fmt.Errorf("push to %v failed response code:%v, info:%v", dest, response.StatusCode, string(respBody))
+		if response.StatusCode >= 400 && response.StatusCode < 500 {
+			return &rejectedError{err: err}
+		}
+		return err
+	}
+
+	if err := s.bodyOK(respBody); err != nil {
+		return &rejectedError{err: fmt.Errorf("push to %v rejected: %v, info:%v", dest, err, string(respBody))}
+	}
+
+	return nil
+}
+
+func (s *Sender) statusOK(code int) bool {
+	if len(s.success.StatusCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+
+	for _, c := range s.success.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bodyOK check the success.body_field of the json response is one of success.body_values
+func (s *Sender) bodyOK(body []byte) error {
+	if s.success.BodyField == "" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("response is not json: %v", err)
+	}
+
+	for _, key := range strings.Split(s.success.BodyField, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("response has no field %v", s.success.BodyField)
+		}
+		if value, ok = object[key]; !ok {
+			return fmt.Errorf("response has no field %v", s.success.BodyField)
+		}
+	}
+
+	got := fmt.Sprint(value)
+	for _, want := range s.success.BodyValues {
+		if got == want {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("response %v is %v, want one of %v", s.success.BodyField, got, s.success.BodyValues)
+}
+
+// spool write body to a new file named by time so the files sort oldest first,
+// dropping the oldest files beyond spoolMax
+func (s *Sender) spool(body []byte) error {
+	if s.spoolDir == "" {
+		return fmt.Errorf("no %v spool_dir configured, batch dropped", s.name)
+	}
+
+	if err := os.MkdirAll(s.spoolDir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Join(s.spoolDir, strconv.FormatInt(time.Now().UnixNano(), 10)+".json")
+	if err := ioutil.WriteFile(name+".tmp", body, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	files, err := s.spooled()
+	if err != nil {
+		return err
+	}
+	for s.spoolMax > 0 && len(files) > s.spoolMax {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// quarantine write the rejected body to the rejected directory of the spool and return the
+// rejection, which says where the body went
+func (s *Sender) quarantine(body []byte, rejection error) error {
+	if s.spoolDir == "" {
+		return fmt.Errorf("%v, batch dropped", rejection)
+	}
+
+	dir := filepath.Join(s.spoolDir, "rejected")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%v, batch dropped: %v", rejection, err)
+	}
+	name := filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10)+".json")
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		return fmt.Errorf("%v, batch dropped: %v", rejection, err)
+	}
+
+	return fmt.Errorf("%v, batch moved to %v", rejection, name)
+}
+
+func (s *Sender) spooled() ([]string, error) {
+	if s.spoolDir == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.spoolDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
@@ -0,0 +1,174 @@
+package http_json_push
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeBarad struct {
+	mu       sync.Mutex
+	down     bool
+	code     string
+	received []string
+}
+
+func (f *fakeBarad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if f.code == "0" {
+		f.received = append(f.received, string(body))
+	}
+	w.Write([]byte(`{"code":` + f.code + `,"message":"m"}`))
+}
+
+func newTestSender(spoolDir string, destinations ...string) *Sender {
+	return &Sender{
+		name:         "test",
+		client:       &http.Client{Timeout: time.Second},
+		method:       "POST",
+		success:      Presets["barad"].Success,
+		destinations: destinations,
+		backoff:      time.Millisecond,
+		spoolDir:     spoolDir,
+		spoolMax:     2,
+	}
+}
+
+func TestSenderFailover(t *testing.T) {
+	good := &fakeBarad{code: "0"}
+	server := httptest.NewServer(good)
+	defer server.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	sender := newTestSender(t.TempDir(), dead.URL, server.URL)
+	if err := sender.Send([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if sender.next != 1 {
+		t.Errorf("next destination = %v, want the one that worked", sender.next)
+	}
+	if len(good.received) != 1 {
+		t.Errorf("received %v, want one body", good.received)
+	}
+}
+
+func TestSenderSpoolAndFlush(t *testing.T) {
+	fake := &fakeBarad{down: true, code: "0"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sender := newTestSender(t.TempDir(), server.URL)
+
+	// barad is unavailable, so every body ends in the spool
+	for _, body := range []string{"1", "2", "3"} {
+		if err := sender.Send([]byte(body)); err == nil {
+			t.Fatalf("send %v to an unavailable barad succeeded", body)
+		}
+	}
+
+	files, err := sender.spooled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("spooled %v files, want spool_max_files 2", len(files))
+	}
+
+	fake.mu.Lock()
+	fake.down = false
+	fake.mu.Unlock()
+
+	if err := sender.Send([]byte("4")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"2", "3", "4"}
+	if len(fake.received) != len(want) {
+		t.Fatalf("received %v, want %v", fake.received, want)
+	}
+	for i := range want {
+		if fake.received[i] != want[i] {
+			t.Errorf("received %v, want %v", fake.received, want)
+			break
+		}
+	}
+
+	if files, _ := sender.spooled(); len(files) != 0 {
+		t.Errorf("spool not emptied: %v", files)
+	}
+}
+
+func TestSenderRejectedNotBlocking(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	fake := &fakeBarad{down: true, code: "0"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir := t.TempDir()
+	sender := newTestSender(dir, server.URL)
+	for _, body := range []string{"code", "html"} {
+		if err := sender.Send([]byte(body)); err == nil {
+			t.Fatal("send to an unavailable barad succeeded")
+		}
+	}
+
+	// the spooled bodies are now rejected for good, they must not block the later ones
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch string(body) {
+		case "4xx":
+			http.Error(w, "bad batch", http.StatusBadRequest)
+			return
+		case "code":
+			w.Write([]byte(`{"code":-1,"message":"m"}`))
+			return
+		case "html":
+			w.Write([]byte("<html>captive portal</html>"))
+			return
+		}
+		fake.mu.Lock()
+		fake.received = append(fake.received, string(body))
+		fake.mu.Unlock()
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer rejecting.Close()
+	sender.destinations = []string{rejecting.URL}
+
+	if err := sender.Send([]byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.received) != 1 || fake.received[0] != "good" {
+		t.Errorf("received %v, want only good", fake.received)
+	}
+	if files, _ := sender.spooled(); len(files) != 0 {
+		t.Errorf("spool not emptied: %v", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "rejected", "*.json")); len(files) != 2 {
+		t.Errorf("rejected files %v, want the code -1 and the html batch", files)
+	}
+
+	// a fresh batch that is rejected is not spooled either
+	if err := sender.Send([]byte("4xx")); err == nil {
+		t.Fatal("send answered with 400 succeeded")
+	}
+	if files, _ := sender.spooled(); len(files) != 0 {
+		t.Errorf("rejected batch spooled: %v", files)
+	}
+}
@@ -1,5 +1,7 @@
 package model
 
+import "encoding/json"
+
 /*
 define barad_ck_push struct
 */
@@ -12,10 +14,25 @@ type BaradCk struct {
 }
 
 type Dimensions struct {
-	AppId      string `json:"appid"`
-	InstanceId string `json:"instanceid"`
-	NodeId     string `json:"nodeid"`
-	ProjectId  string `json:"projectid"`
+	AppId      string            `json:"appid"`
+	InstanceId string            `json:"instanceid"`
+	NodeId     string            `json:"nodeid"`
+	ProjectId  string            `json:"projectid"`
+	Extra      map[string]string `json:"-"`
+}
+
+// MarshalJSON flatten the extra dimensions next to the fixed ones, the fixed ones win on a clash
+func (d Dimensions) MarshalJSON() ([]byte, error) {
+	dimension := make(map[string]string, len(d.Extra)+4)
+	for k, v := range d.Extra {
+		dimension[k] = v
+	}
+	dimension["appid"] = d.AppId
+	dimension["instanceid"] = d.InstanceId
+	dimension["nodeid"] = d.NodeId
+	dimension["projectid"] = d.ProjectId
+
+	return json.Marshal(dimension)
 }
 
 type Batchs struct {
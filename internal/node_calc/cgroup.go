@@ -0,0 +1,396 @@
+package node_calc
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/exporterpush/global"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCgroupRoot is where the cgroup filesystem is mounted, a container sees its own cgroup there
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// selfCgroupFile lists the cgroup of the agent in every hierarchy
+const selfCgroupFile = "/proc/self/cgroup"
+
+// cgroupV1Unlimited is the lowest memory.limit_in_bytes treated as no limit, v1 reports
+// the page aligned maximum int64 when the limit is unset
+const cgroupV1Unlimited = 1 << 62
+
+// CgroupIO is the io of one block device, named by major:minor
+type CgroupIO struct {
+	ReadBytes, WriteBytes, Reads, Writes float64
+}
+
+// CgroupStats are the resource counters and limits of the cgroup the agent runs in
+type CgroupStats struct {
+	Version          int
+	CPUUsageSeconds  float64 // cumulative
+	CPUQuotaCores    float64 // 0 when there is no quota
+	Periods          float64
+	ThrottledPeriods float64
+	ThrottledSeconds float64
+	MemoryUsage      float64 // working set, the usage without the inactive file cache
+	MemoryLimit      float64 // 0 when there is no limit
+	OOMEvents        float64
+	IO               map[string]CgroupIO
+	// Container is true when the cgroup is the one mounted at the cgroup root, as in a container
+	// with its own cgroup namespace or mount, and false for a cgroup on the host like a systemd
+	// service, whose limits are the agent's own and not the ones of the machine it reports
+	Container bool
+}
+
+// DetectCgroup return the cgroup version mounted at root: 2 for the unified hierarchy,
+// 1 for per controller hierarchies and 0 when there is no cgroup filesystem
+func DetectCgroup(root string) int {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return 2
+	}
+
+	for _, controller := range []string{"memory", "cpuacct", "cpu,cpuacct"} {
+		if info, err := os.Stat(filepath.Join(root, controller)); err == nil && info.IsDir() {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// ReadCgroup read the stats of the cgroup at paths, by controller as ReadCgroupPaths returns
+// them, in the cgroup filesystem mounted at root. A path that is not under root, as in a
+// container that has its own cgroup mounted there, reads root itself. The v2 root cgroup is
+// the whole host and has no stats of its own, it reads nil. A counter whose file is missing,
+// as for a controller that is not enabled, is left zero
+func ReadCgroup(root string, paths map[string]string) (*CgroupStats, error) {
+	switch DetectCgroup(root) {
+	case 2:
+		dir := cgroupDir(root, paths[""])
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.type")); os.IsNotExist(err) {
+			return nil, nil
+		}
+		stats, err := readCgroupV2(dir)
+		if stats != nil {
+			stats.Container = filepath.Clean(dir) == filepath.Clean(root)
+		}
+		return stats, err
+	case 1:
+		return readCgroupV1(root, paths)
+	}
+
+	return nil, fmt.Errorf("no cgroup filesystem at %v", root)
+}
+
+// ReadCgroupPaths read the cgroup of a process from a file like /proc/self/cgroup, by v1
+// controller and by "" for the v2 hierarchy
+func ReadCgroupPaths(file string) (map[string]string, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]string{}
+	for _, line := range lines {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		paths[fields[1]] = fields[2]
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+
+	return paths, nil
+}
+
+// cgroupDir return the directory of path under dir, or dir when it does not exist there
+func cgroupDir(dir, path string) string {
+	if path == "" {
+		return dir
+	}
+	if info, err := os.Stat(filepath.Join(dir, path)); err == nil && info.IsDir() {
+		return filepath.Join(dir, path)
+	}
+
+	return dir
+}
+
+func readCgroupV2(root string) (*CgroupStats, error) {
+	stats := &CgroupStats{Version: 2, IO: map[string]CgroupIO{}}
+
+	cpuStat, err := readKeyValues(filepath.Join(root, "cpu.stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	stats.CPUUsageSeconds = cpuStat["usage_usec"] / 1e6
+	stats.Periods = cpuStat["nr_periods"]
+	stats.ThrottledPeriods = cpuStat["nr_throttled"]
+	stats.ThrottledSeconds = cpuStat["throttled_usec"] / 1e6
+
+	if fields, err := readFields(filepath.Join(root, "cpu.max")); err == nil && len(fields) == 2 && fields[0] != "max" {
+		quota, _ := strconv.ParseFloat(fields[0], 64)
+		period, _ := strconv.ParseFloat(fields[1], 64)
+		if period > 0 {
+			stats.CPUQuotaCores = quota / period
+		}
+	}
+
+	stats.MemoryUsage, _ = readFloat(filepath.Join(root, "memory.current"))
+	if fields, err := readFields(filepath.Join(root, "memory.max")); err == nil && len(fields) == 1 && fields[0] != "max" {
+		stats.MemoryLimit, _ = strconv.ParseFloat(fields[0], 64)
+	}
+	memoryStat, _ := readKeyValues(filepath.Join(root, "memory.stat"))
+	stats.MemoryUsage = workingSet(stats.MemoryUsage, memoryStat["inactive_file"])
+
+	events, _ := readKeyValues(filepath.Join(root, "memory.events"))
+	stats.OOMEvents = events["oom_kill"]
+
+	lines, err := readLines(filepath.Join(root, "io.stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		io := CgroupIO{}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, _ := strconv.ParseFloat(parts[1], 64)
+			switch parts[0] {
+			case "rbytes":
+				io.ReadBytes = value
+			case "wbytes":
+				io.WriteBytes = value
+			case "rios":
+				io.Reads = value
+			case "wios":
+				io.Writes = value
+			}
+		}
+		stats.IO[fields[0]] = io
+	}
+
+	return stats, nil
+}
+
+func readCgroupV1(root string, paths map[string]string) (*CgroupStats, error) {
+	stats := &CgroupStats{Version: 1, IO: map[string]CgroupIO{}}
+
+	cpuDir := controllerDir(root, paths, "cpu", "cpu,cpuacct")
+	cpuacctDir := controllerDir(root, paths, "cpuacct", "cpu,cpuacct")
+
+	if usage, err := readFloat(filepath.Join(cpuacctDir, "cpuacct.usage")); err == nil {
+		stats.CPUUsageSeconds = usage / 1e9
+	}
+
+	cpuStat, _ := readKeyValues(filepath.Join(cpuDir, "cpu.stat"))
+	stats.Periods = cpuStat["nr_periods"]
+	stats.ThrottledPeriods = cpuStat["nr_throttled"]
+	stats.ThrottledSeconds = cpuStat["throttled_time"] / 1e9
+
+	quota, err := readFloat(filepath.Join(cpuDir, "cpu.cfs_quota_us"))
+	if err == nil && quota > 0 {
+		if period, err := readFloat(filepath.Join(cpuDir, "cpu.cfs_period_us")); err == nil && period > 0 {
+			stats.CPUQuotaCores = quota / period
+		}
+	}
+
+	memoryDir := controllerDir(root, paths, "memory")
+	stats.Container = filepath.Dir(cpuDir) == filepath.Clean(root) && filepath.Dir(memoryDir) == filepath.Clean(root)
+
+	usage, _ := readFloat(filepath.Join(memoryDir, "memory.usage_in_bytes"))
+	memoryStat, _ := readKeyValues(filepath.Join(memoryDir, "memory.stat"))
+	stats.MemoryUsage = workingSet(usage, memoryStat["total_inactive_file"])
+	if limit, err := readFloat(filepath.Join(memoryDir, "memory.limit_in_bytes")); err == nil && limit < cgroupV1Unlimited {
+		stats.MemoryLimit = limit
+	}
+
+	oomControl, _ := readKeyValues(filepath.Join(memoryDir, "memory.oom_control"))
+	stats.OOMEvents = oomControl["oom_kill"]
+
+	blkioDir := controllerDir(root, paths, "blkio")
+	for _, file := range []struct {
+		name        string
+		read, write func(*CgroupIO, float64)
+	}{
+		{"blkio.throttle.io_service_bytes",
+			func(io *CgroupIO, v float64) { io.ReadBytes = v }, func(io *CgroupIO, v float64) { io.WriteBytes = v }},
+		{"blkio.throttle.io_serviced",
+			func(io *CgroupIO, v float64) { io.Reads = v }, func(io *CgroupIO, v float64) { io.Writes = v }},
+	} {
+		lines, _ := readLines(filepath.Join(blkioDir, file.name))
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+			value, _ := strconv.ParseFloat(fields[2], 64)
+
+			io := stats.IO[fields[0]]
+			switch fields[1] {
+			case "Read":
+				file.read(&io, value)
+			case "Write":
+				file.write(&io, value)
+			default:
+				continue
+			}
+			stats.IO[fields[0]] = io
+		}
+	}
+
+	return stats, nil
+}
+
+// controllerDir return the cgroup at paths in the first directory of a v1 controller that
+// exists under root
+func controllerDir(root string, paths map[string]string, names ...string) string {
+	for _, name := range names {
+		dir := filepath.Join(root, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return cgroupDir(dir, paths[name])
+		}
+	}
+
+	return filepath.Join(root, names[0])
+}
+
+func workingSet(usage, inactiveFile float64) float64 {
+	if inactiveFile > usage {
+		return 0
+	}
+
+	return usage - inactiveFile
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+func readFields(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(content)), nil
+}
+
+func readFloat(path string) (float64, error) {
+	fields, err := readFields(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) != 1 {
+		return 0, fmt.Errorf("%v has %v values, want 1", path, len(fields))
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readKeyValues read a flat keyed file of "key value" lines such as cpu.stat
+func readKeyValues(path string) (map[string]float64, error) {
+	result := map[string]float64{}
+
+	lines, err := readLines(path)
+	if err != nil {
+		return result, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			result[fields[0]] = value
+		}
+	}
+
+	return result, nil
+}
+
+// CgroupSampler calculates the CPU usage of the cgroup the agent runs in between two calls,
+// against its quota when there is one and against the CPUs the agent may run on otherwise.
+// Without a root it reads global.cgroup_root, or /sys/fs/cgroup when that is not set
+type CgroupSampler struct {
+	root       string
+	selfCgroup string
+
+	mu        sync.Mutex
+	lastUsage float64
+	lastTime  time.Time
+}
+
+// NewCgroupSampler return a CgroupSampler reading the cgroup mounted at root
+func NewCgroupSampler(root string) *CgroupSampler {
+	return &CgroupSampler{root: root, selfCgroup: selfCgroupFile}
+}
+
+// Sample read the cgroup stats and the CPU usage percent since the previous call, ok is false
+// for the first call. Stats are nil when there is no cgroup filesystem or the agent runs in
+// the v2 root cgroup
+func (s *CgroupSampler) Sample(now time.Time) (stats *CgroupStats, cpuPercent float64, ok bool, err error) {
+	root := s.root
+	if root == "" && global.GlobalSetting != nil {
+		root = global.GlobalSetting.CgroupRoot
+	}
+	if root == "" {
+		root = DefaultCgroupRoot
+	}
+	if DetectCgroup(root) == 0 {
+		return nil, 0, false, nil
+	}
+
+	// without the file, the cgroup mounted at root is the one of the agent
+	paths, _ := ReadCgroupPaths(s.selfCgroup)
+	stats, err = ReadCgroup(root, paths)
+	if err != nil || stats == nil {
+		return nil, 0, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastUsage, lastTime := s.lastUsage, s.lastTime
+	s.lastUsage, s.lastTime = stats.CPUUsageSeconds, now
+
+	elapsed := now.Sub(lastTime).Seconds()
+	if lastTime.IsZero() || elapsed <= 0 || stats.CPUUsageSeconds < lastUsage {
+		return stats, 0, false, nil
+	}
+
+	cores := stats.CPUQuotaCores
+	if cores <= 0 {
+		cores = float64(runtime.NumCPU())
+	}
+
+	return stats, (stats.CPUUsageSeconds - lastUsage) / elapsed / cores * 100, true, nil
+}
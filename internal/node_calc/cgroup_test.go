@@ -0,0 +1,209 @@
+package node_calc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadCgroupV2(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu io memory pids\n",
+		"cgroup.type":        "domain\n",
+		"cpu.stat":           "usage_usec 5000000\nuser_usec 3000000\nsystem_usec 2000000\nnr_periods 100\nnr_throttled 7\nthrottled_usec 250000\n",
+		"cpu.max":            "150000 100000\n",
+		"memory.current":     "209715200\n",
+		"memory.max":         "419430400\n",
+		"memory.stat":        "anon 100\nfile 200\ninactive_file 104857600\n",
+		"memory.events":      "low 0\nhigh 0\nmax 3\noom 2\noom_kill 1\n",
+		"io.stat":            "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n253:1 rbytes=10 wbytes=20 rios=3 wios=4\n",
+	})
+
+	if DetectCgroup(root) != 2 {
+		t.Fatalf("version = %v, want 2", DetectCgroup(root))
+	}
+	stats, err := ReadCgroup(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, got := range map[string][2]float64{
+		"cpu usage":         {stats.CPUUsageSeconds, 5},
+		"cpu quota":         {stats.CPUQuotaCores, 1.5},
+		"periods":           {stats.Periods, 100},
+		"throttled periods": {stats.ThrottledPeriods, 7},
+		"throttled seconds": {stats.ThrottledSeconds, 0.25},
+		"memory usage":      {stats.MemoryUsage, 104857600},
+		"memory limit":      {stats.MemoryLimit, 419430400},
+		"oom events":        {stats.OOMEvents, 1},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%v = %v, want %v", name, got[0], got[1])
+		}
+	}
+	if stats.IO["8:0"] != (CgroupIO{ReadBytes: 4096, WriteBytes: 8192, Reads: 1, Writes: 2}) {
+		t.Errorf("io 8:0 = %+v", stats.IO["8:0"])
+	}
+	if len(stats.IO) != 2 {
+		t.Errorf("io devices = %v, want 2", len(stats.IO))
+	}
+
+	// without limits
+	writeCgroupFiles(t, root, map[string]string{"cpu.max": "max 100000\n", "memory.max": "max\n"})
+	stats, err = ReadCgroup(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CPUQuotaCores != 0 || stats.MemoryLimit != 0 {
+		t.Errorf("quota = %v, limit = %v, want no limits", stats.CPUQuotaCores, stats.MemoryLimit)
+	}
+}
+
+func TestReadCgroupV1(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cpu,cpuacct/cpuacct.usage":             "2500000000\n",
+		"cpu,cpuacct/cpu.stat":                  "nr_periods 50\nnr_throttled 5\nthrottled_time 1000000000\n",
+		"cpu,cpuacct/cpu.cfs_quota_us":          "50000\n",
+		"cpu,cpuacct/cpu.cfs_period_us":         "100000\n",
+		"memory/memory.usage_in_bytes":          "1000\n",
+		"memory/memory.stat":                    "cache 300\ntotal_inactive_file 400\n",
+		"memory/memory.limit_in_bytes":          "9223372036854771712\n",
+		"memory/memory.oom_control":             "oom_kill_disable 0\nunder_oom 0\noom_kill 3\n",
+		"blkio/blkio.throttle.io_service_bytes": "8:0 Read 4096\n8:0 Write 8192\n8:0 Sync 0\n8:0 Total 12288\nTotal 12288\n",
+		"blkio/blkio.throttle.io_serviced":      "8:0 Read 1\n8:0 Write 2\n8:0 Total 3\nTotal 3\n",
+	})
+
+	if DetectCgroup(root) != 1 {
+		t.Fatalf("version = %v, want 1", DetectCgroup(root))
+	}
+	stats, err := ReadCgroup(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, got := range map[string][2]float64{
+		"cpu usage":         {stats.CPUUsageSeconds, 2.5},
+		"cpu quota":         {stats.CPUQuotaCores, 0.5},
+		"throttled periods": {stats.ThrottledPeriods, 5},
+		"throttled seconds": {stats.ThrottledSeconds, 1},
+		"memory usage":      {stats.MemoryUsage, 600},
+		"memory limit":      {stats.MemoryLimit, 0},
+		"oom events":        {stats.OOMEvents, 3},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%v = %v, want %v", name, got[0], got[1])
+		}
+	}
+	if stats.IO["8:0"] != (CgroupIO{ReadBytes: 4096, WriteBytes: 8192, Reads: 1, Writes: 2}) {
+		t.Errorf("io 8:0 = %+v", stats.IO["8:0"])
+	}
+}
+
+func TestReadOwnCgroup(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory\n",
+		"cpu.stat":           "usage_usec 9000000\n",
+		"system.slice/exporterpush.service/cgroup.type":    "domain\n",
+		"system.slice/exporterpush.service/cpu.stat":       "usage_usec 1000000\n",
+		"system.slice/exporterpush.service/memory.current": "4096\n",
+	})
+	self := filepath.Join(t.TempDir(), "cgroup")
+
+	writeCgroupFiles(t, filepath.Dir(self), map[string]string{"cgroup": "0::/system.slice/exporterpush.service\n"})
+	paths, err := ReadCgroupPaths(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ReadCgroup(root, paths)
+	if err != nil || stats == nil {
+		t.Fatalf("stats = %v, err = %v", stats, err)
+	}
+	if stats.CPUUsageSeconds != 1 || stats.MemoryUsage != 4096 {
+		t.Errorf("cpu = %v, memory = %v, want the agent's own cgroup", stats.CPUUsageSeconds, stats.MemoryUsage)
+	}
+	if stats.Container {
+		t.Error("a systemd service cgroup on the host is not a container")
+	}
+
+	// the root cgroup of a bare-metal host has no stats of its own
+	writeCgroupFiles(t, filepath.Dir(self), map[string]string{"cgroup": "0::/\n"})
+	paths, _ = ReadCgroupPaths(self)
+	if stats, err := ReadCgroup(root, paths); err != nil || stats != nil {
+		t.Errorf("stats = %v, err = %v, want nil for the root cgroup", stats, err)
+	}
+
+	// v1 reads the cgroup of the agent in every controller hierarchy
+	root = t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"memory/memory.usage_in_bytes":            "100000\n",
+		"memory/user.slice/memory.usage_in_bytes": "1000\n",
+	})
+	writeCgroupFiles(t, filepath.Dir(self), map[string]string{"cgroup": "7:memory:/user.slice\n4:cpu,cpuacct:/user.slice\n"})
+	paths, _ = ReadCgroupPaths(self)
+	if stats, err := ReadCgroup(root, paths); err != nil || stats.MemoryUsage != 1000 || stats.Container {
+		t.Errorf("stats = %+v, err = %v, want memory usage 1000 of user.slice on the host", stats, err)
+	}
+
+	// a v1 container has its own cgroup mounted at root, the host path is not found there
+	writeCgroupFiles(t, filepath.Dir(self), map[string]string{"cgroup": "7:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n"})
+	paths, _ = ReadCgroupPaths(self)
+	if stats, err := ReadCgroup(root, paths); err != nil || stats.MemoryUsage != 100000 || !stats.Container {
+		t.Errorf("stats = %+v, err = %v, want the container cgroup mounted at root", stats, err)
+	}
+}
+
+func TestCgroupSampler(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory\n",
+		"cgroup.type":        "domain\n",
+		"cpu.stat":           "usage_usec 1000000\n",
+		"cpu.max":            "200000 100000\n",
+	})
+
+	sampler := NewCgroupSampler(root)
+	sampler.selfCgroup = filepath.Join(root, "no-such-file")
+	now := time.Now()
+	if _, _, ok, err := sampler.Sample(now); err != nil || ok {
+		t.Fatalf("first sample ok = %v, err = %v, want no usage", ok, err)
+	}
+
+	// one CPU second in one wall second against a quota of two cores
+	writeCgroupFiles(t, root, map[string]string{"cpu.stat": "usage_usec 2000000\n"})
+	_, usage, ok, err := sampler.Sample(now.Add(time.Second))
+	if err != nil || !ok {
+		t.Fatalf("ok = %v, err = %v", ok, err)
+	}
+	if usage != 50 {
+		t.Errorf("usage = %v, want 50", usage)
+	}
+
+	// a v2 container sees its own cgroup as the namespace root
+	sampler.selfCgroup = filepath.Join(root, "self")
+	writeCgroupFiles(t, root, map[string]string{"self": "0::/\n"})
+	if stats, _, _, err := sampler.Sample(now.Add(2 * time.Second)); err != nil || stats == nil || !stats.Container {
+		t.Errorf("stats = %+v, err = %v, want the container cgroup", stats, err)
+	}
+
+	stats, _, _, err := NewCgroupSampler(t.TempDir()).Sample(now)
+	if err != nil || stats != nil {
+		t.Errorf("stats = %v, err = %v, want nil without a cgroup filesystem", stats, err)
+	}
+}
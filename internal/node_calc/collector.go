@@ -0,0 +1,410 @@
+package node_calc
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const namespace = "node"
+
+var (
+	scrapeSuccessDesc = prometheus.NewDesc("node_scrape_collector_success",
+		"node_exporter: Whether a collector succeeded.", []string{"collector"}, nil)
+	scrapeDurationDesc = prometheus.NewDesc("node_scrape_collector_duration_seconds",
+		"node_exporter: Duration of a collector scrape.", []string{"collector"}, nil)
+
+	cpuSecondsDesc = prometheus.NewDesc("node_cpu_seconds_total",
+		"Seconds the CPUs spent in each mode.", []string{"cpu", "mode"}, nil)
+
+	loadDescs = []*prometheus.Desc{
+		prometheus.NewDesc("node_load1", "1m load average.", nil, nil),
+		prometheus.NewDesc("node_load5", "5m load average.", nil, nil),
+		prometheus.NewDesc("node_load15", "15m load average.", nil, nil),
+	}
+
+	filesystemLabels    = []string{"device", "fstype", "mountpoint"}
+	filesystemSizeDesc  = newDesc("filesystem", "size_bytes", "Filesystem size in bytes.", filesystemLabels)
+	filesystemFreeDesc  = newDesc("filesystem", "free_bytes", "Filesystem free space in bytes.", filesystemLabels)
+	filesystemAvailDesc = newDesc("filesystem", "avail_bytes", "Filesystem space available to non-root users in bytes.", filesystemLabels)
+	filesystemFilesDesc = newDesc("filesystem", "files", "Filesystem total file nodes.", filesystemLabels)
+	filesystemFreeFiles = newDesc("filesystem", "files_free", "Filesystem total free file nodes.", filesystemLabels)
+
+	diskLabels             = []string{"device"}
+	diskReadsDesc          = newDesc("disk", "reads_completed_total", "The total number of reads completed successfully.", diskLabels)
+	diskReadsMergedDesc    = newDesc("disk", "reads_merged_total", "The total number of reads merged.", diskLabels)
+	diskReadBytesDesc      = newDesc("disk", "read_bytes_total", "The total number of bytes read successfully.", diskLabels)
+	diskReadTimeDesc       = newDesc("disk", "read_time_seconds_total", "The total number of seconds spent by all reads.", diskLabels)
+	diskWritesDesc         = newDesc("disk", "writes_completed_total", "The total number of writes completed successfully.", diskLabels)
+	diskWritesMergedDesc   = newDesc("disk", "writes_merged_total", "The number of writes merged.", diskLabels)
+	diskWrittenBytesDesc   = newDesc("disk", "written_bytes_total", "The total number of bytes written successfully.", diskLabels)
+	diskWriteTimeDesc      = newDesc("disk", "write_time_seconds_total", "This is the total number of seconds spent by all writes.", diskLabels)
+	diskIONowDesc          = newDesc("disk", "io_now", "The number of I/Os currently in progress.", diskLabels)
+	diskIOTimeDesc         = newDesc("disk", "io_time_seconds_total", "Total seconds spent doing I/Os.", diskLabels)
+	diskIOTimeWeightedDesc = newDesc("disk", "io_time_weighted_seconds_total", "The weighted # of seconds spent doing I/Os.", diskLabels)
+
+	netLabels = []string{"device"}
+
+	tcpStatesDesc = prometheus.NewDesc("node_tcp_connection_states",
+		"Number of connection states.", []string{"state"}, nil)
+)
+
+// memoryFields are the node_memory_<field>_bytes gauges read from the virtual memory stat
+var memoryFields = []struct {
+	name  string
+	value func(*mem.VirtualMemoryStat) uint64
+}{
+	{"MemTotal", func(m *mem.VirtualMemoryStat) uint64 { return m.Total }},
+	{"MemFree", func(m *mem.VirtualMemoryStat) uint64 { return m.Free }},
+	{"MemAvailable", func(m *mem.VirtualMemoryStat) uint64 { return m.Available }},
+	{"Buffers", func(m *mem.VirtualMemoryStat) uint64 { return m.Buffers }},
+	{"Cached", func(m *mem.VirtualMemoryStat) uint64 { return m.Cached }},
+	{"Slab", func(m *mem.VirtualMemoryStat) uint64 { return m.Slab }},
+	{"Dirty", func(m *mem.VirtualMemoryStat) uint64 { return m.Dirty }},
+	{"SwapTotal", func(m *mem.VirtualMemoryStat) uint64 { return m.SwapTotal }},
+	{"SwapFree", func(m *mem.VirtualMemoryStat) uint64 { return m.SwapFree }},
+}
+
+// netdevFields are the node_network_<field>_total counters read from the interface counters
+var netdevFields = []struct {
+	name  string
+	value func(net.IOCountersStat) uint64
+}{
+	{"receive_bytes", func(n net.IOCountersStat) uint64 { return n.BytesRecv }},
+	{"transmit_bytes", func(n net.IOCountersStat) uint64 { return n.BytesSent }},
+	{"receive_packets", func(n net.IOCountersStat) uint64 { return n.PacketsRecv }},
+	{"transmit_packets", func(n net.IOCountersStat) uint64 { return n.PacketsSent }},
+	{"receive_errs", func(n net.IOCountersStat) uint64 { return n.Errin }},
+	{"transmit_errs", func(n net.IOCountersStat) uint64 { return n.Errout }},
+	{"receive_drop", func(n net.IOCountersStat) uint64 { return n.Dropin }},
+	{"transmit_drop", func(n net.IOCountersStat) uint64 { return n.Dropout }},
+}
+
+var (
+	memoryDescs  = map[string]*prometheus.Desc{}
+	netdevDescs  = map[string]*prometheus.Desc{}
+	netstatDescs = map[string]*prometheus.Desc{}
+)
+
+func init() {
+	for _, f := range memoryFields {
+		memoryDescs[f.name] = newDesc("memory", f.name+"_bytes", "Memory information field "+f.name+"_bytes.", nil)
+	}
+	for _, f := range netdevFields {
+		netdevDescs[f.name] = newDesc("network", f.name+"_total", "Network device statistic "+f.name+".", netLabels)
+	}
+	for field := range tcpSNMPFamilies {
+		netstatDescs[field] = newDesc("netstat", "Tcp_"+field, "Statistic Tcp"+field+".", nil)
+	}
+}
+
+func newDesc(subsystem, name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+// Collector exposes the host metrics gathered through gopsutil under the node_exporter
+// metric names, so the agent can replace a separately deployed node_exporter. Each part
+// reports node_scrape_collector_success, a failing part does not hide the others
+type Collector struct {
+	collectors map[string]func(ch chan<- prometheus.Metric) error
+}
+
+// NewCollector return the host Collector
+func NewCollector() *Collector {
+	return &Collector{collectors: map[string]func(ch chan<- prometheus.Metric) error{
+		"cpu":        collectCPU,
+		"meminfo":    collectMemory,
+		"filesystem": collectFilesystem,
+		"diskstats":  collectDiskstats,
+		"netdev":     collectNetdev,
+		"loadavg":    collectLoad,
+		"netstat":    collectNetstat,
+		"tcpstat":    collectTCPStates,
+	}}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- scrapeSuccessDesc
+	ch <- scrapeDurationDesc
+	ch <- cpuSecondsDesc
+	ch <- tcpStatesDesc
+	for _, desc := range netstatDescs {
+		ch <- desc
+	}
+	for _, desc := range loadDescs {
+		ch <- desc
+	}
+	for _, desc := range memoryDescs {
+		ch <- desc
+	}
+	for _, desc := range netdevDescs {
+		ch <- desc
+	}
+	for _, desc := range []*prometheus.Desc{filesystemSizeDesc, filesystemFreeDesc, filesystemAvailDesc,
+		filesystemFilesDesc, filesystemFreeFiles, diskReadsDesc, diskReadsMergedDesc, diskReadBytesDesc,
+		diskReadTimeDesc, diskWritesDesc, diskWritesMergedDesc, diskWrittenBytesDesc, diskWriteTimeDesc,
+		diskIONowDesc, diskIOTimeDesc, diskIOTimeWeightedDesc} {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for name, collect := range c.collectors {
+		begin := time.Now()
+		err := collect(ch)
+		duration := time.Since(begin)
+
+		success := 1.0
+		if err != nil {
+			success = 0
+			global.LogObj.Errorf("builtin node collector %v error: %v", name, err)
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+	}
+}
+
+func collectCPU(ch chan<- prometheus.Metric) error {
+	times, err := cpu.Times(true)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range times {
+		core := strings.TrimPrefix(t.CPU, "cpu")
+		for mode, value := range map[string]float64{
+			"user": t.User, "nice": t.Nice, "system": t.System, "idle": t.Idle,
+			"iowait": t.Iowait, "irq": t.Irq, "softirq": t.Softirq, "steal": t.Steal,
+		} {
+			ch <- prometheus.MustNewConstMetric(cpuSecondsDesc, prometheus.CounterValue, value, core, mode)
+		}
+	}
+
+	return nil
+}
+
+func collectMemory(ch chan<- prometheus.Metric) error {
+	memInfo, err := mem.VirtualMemory()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range memoryFields {
+		ch <- prometheus.MustNewConstMetric(memoryDescs[f.name], prometheus.GaugeValue, float64(f.value(memInfo)))
+	}
+
+	return nil
+}
+
+func collectFilesystem(ch chan<- prometheus.Metric) error {
+	filter, err := MountpointFilter()
+	if err != nil {
+		return err
+	}
+
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	all := []string{}
+	for _, p := range partitions {
+		if seen[p.Mountpoint] {
+			continue
+		}
+		seen[p.Mountpoint] = true
+		all = append(all, p.Mountpoint)
+		if !filter.Match(p.Mountpoint) {
+			continue
+		}
+
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil {
+			global.LogObj.Warnf("builtin node collector filesystem %v error: %v", p.Mountpoint, err)
+			continue
+		}
+
+		labels := []string{p.Device, p.Fstype, p.Mountpoint}
+		ch <- prometheus.MustNewConstMetric(filesystemSizeDesc, prometheus.GaugeValue, float64(usage.Total), labels...)
+		ch <- prometheus.MustNewConstMetric(filesystemFreeDesc, prometheus.GaugeValue, float64(usage.Total-usage.Used), labels...)
+		ch <- prometheus.MustNewConstMetric(filesystemAvailDesc, prometheus.GaugeValue, float64(usage.Free), labels...)
+		ch <- prometheus.MustNewConstMetric(filesystemFilesDesc, prometheus.GaugeValue, float64(usage.InodesTotal), labels...)
+		ch <- prometheus.MustNewConstMetric(filesystemFreeFiles, prometheus.GaugeValue, float64(usage.InodesFree), labels...)
+	}
+
+	if missing := filter.Missing(all); len(missing) > 0 {
+		return fmt.Errorf("configured mountpoints %v are not mounted", missing)
+	}
+
+	return nil
+}
+
+func collectDiskstats(ch chan<- prometheus.Metric) error {
+	filter, err := DiskFilter()
+	if err != nil {
+		return err
+	}
+
+	counters, err := GetDiskRWAndIO(filter)
+	for device, io := range counters {
+		for desc, value := range map[*prometheus.Desc]float64{
+			diskReadsDesc:          float64(io.ReadCount),
+			diskReadsMergedDesc:    float64(io.MergedReadCount),
+			diskReadBytesDesc:      float64(io.ReadBytes),
+			diskReadTimeDesc:       float64(io.ReadTime) / 1000,
+			diskWritesDesc:         float64(io.WriteCount),
+			diskWritesMergedDesc:   float64(io.MergedWriteCount),
+			diskWrittenBytesDesc:   float64(io.WriteBytes),
+			diskWriteTimeDesc:      float64(io.WriteTime) / 1000,
+			diskIOTimeDesc:         float64(io.IoTime) / 1000,
+			diskIOTimeWeightedDesc: float64(io.WeightedIO) / 1000,
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, device)
+		}
+		ch <- prometheus.MustNewConstMetric(diskIONowDesc, prometheus.GaugeValue, float64(io.IopsInProgress), device)
+	}
+
+	return err
+}
+
+func collectNetdev(ch chan<- prometheus.Metric) error {
+	filter, err := InterfaceFilter()
+	if err != nil {
+		return err
+	}
+
+	counters, err := GetNetWorkInfo(filter)
+	for _, n := range counters {
+		for _, f := range netdevFields {
+			ch <- prometheus.MustNewConstMetric(netdevDescs[f.name], prometheus.CounterValue, float64(f.value(n)), n.Name)
+		}
+	}
+
+	return err
+}
+
+func collectLoad(ch chan<- prometheus.Metric) error {
+	avg, err := load.Avg()
+	if err != nil {
+		return err
+	}
+
+	for i, value := range []float64{avg.Load1, avg.Load5, avg.Load15} {
+		ch <- prometheus.MustNewConstMetric(loadDescs[i], prometheus.GaugeValue, value)
+	}
+
+	return nil
+}
+
+func collectNetstat(ch chan<- prometheus.Metric) error {
+	stat, err := GetTCPStat()
+	if err != nil {
+		return err
+	}
+
+	for field, desc := range netstatDescs {
+		if value, ok := stat.SNMP[field]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value)
+		}
+	}
+
+	return nil
+}
+
+func collectTCPStates(ch chan<- prometheus.Metric) error {
+	stat, err := GetTCPStat()
+	if err != nil {
+		return err
+	}
+
+	for state, count := range stat.States {
+		ch <- prometheus.MustNewConstMetric(tcpStatesDesc, prometheus.GaugeValue, count, state)
+	}
+
+	return nil
+}
+
+// HostCollector exposes the host_* families the barad mapping selects from, with their usage and
+// rate values calculated by its own HostSampler, so they are available as prometheus series too.
+// Collects within maxAge of the last sample reuse it, so the sinks gathering on the same interval
+// do not move the baseline of each other's rates forward
+type HostCollector struct {
+	sampler *HostSampler
+	maxAge  time.Duration
+
+	mu       sync.Mutex
+	sampled  time.Time
+	families map[string]*prom2json.Family
+}
+
+// NewHostCollector return a HostCollector with a fresh HostSampler, sampling at most once per maxAge
+func NewHostCollector(maxAge time.Duration) *HostCollector {
+	return &HostCollector{sampler: NewHostSampler(), maxAge: maxAge}
+}
+
+// Describe sends nothing, the series depend on the devices of the host
+func (c *HostCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *HostCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, family := range c.sample() {
+		valueType := prometheus.GaugeValue
+		if family.Type == "COUNTER" {
+			valueType = prometheus.CounterValue
+		}
+
+		for _, item := range family.Metrics {
+			metric, ok := item.(prom2json.Metric)
+			if !ok {
+				continue
+			}
+			value, err := strconv.ParseFloat(metric.Value, 64)
+			if err != nil {
+				continue
+			}
+
+			labelNames := make([]string, 0, len(metric.Labels))
+			for k := range metric.Labels {
+				labelNames = append(labelNames, k)
+			}
+			sort.Strings(labelNames)
+			labelValues := make([]string, 0, len(labelNames))
+			for _, k := range labelNames {
+				labelValues = append(labelValues, metric.Labels[k])
+			}
+
+			desc := prometheus.NewDesc(name, "Host metric "+name+" of the exporterpush agent.", labelNames, nil)
+			ch <- prometheus.MustNewConstMetric(desc, valueType, value, labelValues...)
+		}
+	}
+}
+
+// sample return the families of the last sample while it is younger than maxAge, the families
+// are only read afterwards
+func (c *HostCollector) sample() map[string]*prom2json.Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.families != nil && time.Since(c.sampled) < c.maxAge {
+		return c.families
+	}
+
+	families, err := c.sampler.Families()
+	if err != nil {
+		global.LogObj.Errorf("builtin host collector error: %v", err)
+	}
+	c.families, c.sampled = families, time.Now()
+
+	return c.families
+}
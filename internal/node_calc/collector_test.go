@@ -0,0 +1,82 @@
+package node_calc
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	global.GlobalSetting = &setting.GlobalS{}
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(NewCollector()); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, mf := range families {
+		names[mf.GetName()] = true
+	}
+
+	for _, name := range []string{"node_cpu_seconds_total", "node_memory_MemTotal_bytes", "node_memory_MemAvailable_bytes",
+		"node_network_receive_bytes_total", "node_load1", "node_scrape_collector_success"} {
+		if !names[name] {
+			t.Errorf("builtin node collector lacks %v", name)
+		}
+	}
+}
+
+func TestHostFamiliesMissingMountpoint(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	global.GlobalSetting = &setting.GlobalS{}
+	global.GlobalSetting.Devices.Mountpoints.Include = []string{"/", "/no/such/mountpoint"}
+
+	families, err := NewHostSampler().Families()
+	if err == nil {
+		t.Error("no error for a mountpoint that is not mounted")
+	}
+	for _, name := range []string{"host_cpu_usage_percent", "host_memory_used_percent", "host_disk_used_bytes"} {
+		if families[name] == nil {
+			t.Errorf("host families lack %v when one mountpoint is not mounted", name)
+		}
+	}
+
+	// a mapping summing the family must get the host value, the cores have their own family
+	if cpu := families["host_cpu_usage_percent"]; cpu != nil {
+		if len(cpu.Metrics) != 1 || len(cpu.Metrics[0].(prom2json.Metric).Labels) != 0 {
+			t.Errorf("host_cpu_usage_percent = %+v, want one unlabelled series", cpu.Metrics)
+		}
+	}
+}
+
+func TestHostCollectorShareSample(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	global.GlobalSetting = &setting.GlobalS{}
+
+	c := NewHostCollector(time.Hour)
+	first := c.sample()
+	sampled := c.sampled
+	c.sample()
+	if c.sampled != sampled || len(c.families) != len(first) {
+		t.Error("sampled again within maxAge, moving the rate baseline of the other sinks")
+	}
+
+	c.maxAge = 0
+	c.sample()
+	if c.sampled == sampled {
+		t.Error("not sampled again after maxAge")
+	}
+}
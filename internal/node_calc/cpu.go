@@ -0,0 +1,115 @@
+package node_calc
+
+import (
+	"github.com/shirou/gopsutil/v3/cpu"
+	"sort"
+	"sync"
+)
+
+// cpuModes are the modes CPU time is split into, guest time is already counted in user
+var cpuModes = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+
+func cpuModeTimes(t cpu.TimesStat) map[string]float64 {
+	return map[string]float64{
+		"user": t.User, "nice": t.Nice, "system": t.System, "idle": t.Idle,
+		"iowait": t.Iowait, "irq": t.Irq, "softirq": t.Softirq, "steal": t.Steal,
+	}
+}
+
+// CPUUsage is the CPU time split between the modes since the previous sample, in percent
+type CPUUsage struct {
+	Usage float64            // busy percent, everything but idle and iowait
+	Modes map[string]float64 // percent of the time spent in each mode
+}
+
+// CPUSample is the usage of all CPUs together and of each core
+type CPUSample struct {
+	Total   CPUUsage
+	PerCore map[string]CPUUsage
+}
+
+// CPUSampler calculates the CPU usage from the difference between the cumulative cpu.Times of
+// two calls, so a sample covers the whole time since the previous one and never sleeps. The
+// first sample covers the time since boot. Every consumer needs its own sampler, as a call
+// moves the start of the next sample
+type CPUSampler struct {
+	mu   sync.Mutex
+	last map[string]cpu.TimesStat
+}
+
+// NewCPUSampler return a CPUSampler without a previous sample
+func NewCPUSampler() *CPUSampler {
+	return &CPUSampler{last: map[string]cpu.TimesStat{}}
+}
+
+// Sample read the per core times and return the usage since the previous call
+func (s *CPUSampler) Sample() (*CPUSample, error) {
+	times, err := cpu.Times(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sample(times), nil
+}
+
+func (s *CPUSampler) sample(times []cpu.TimesStat) *CPUSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &CPUSample{PerCore: make(map[string]CPUUsage, len(times))}
+	totalDelta := map[string]float64{}
+	current := make(map[string]cpu.TimesStat, len(times))
+
+	sort.Slice(times, func(i, j int) bool { return times[i].CPU < times[j].CPU })
+	for _, t := range times {
+		current[t.CPU] = t
+		now, before := cpuModeTimes(t), cpuModeTimes(s.last[t.CPU])
+
+		delta := map[string]float64{}
+		for _, mode := range cpuModes {
+			delta[mode] = now[mode] - before[mode]
+		}
+		// a core that went offline and back, or a counter that wrapped, starts from zero
+		for _, mode := range cpuModes {
+			if delta[mode] < 0 {
+				delta = now
+				break
+			}
+		}
+
+		for mode, d := range delta {
+			totalDelta[mode] += d
+		}
+		result.PerCore[t.CPU] = cpuUsage(delta)
+	}
+
+	s.last = current
+	result.Total = cpuUsage(totalDelta)
+
+	return result
+}
+
+func cpuUsage(delta map[string]float64) CPUUsage {
+	usage := CPUUsage{Modes: make(map[string]float64, len(cpuModes))}
+
+	total := 0.0
+	for _, mode := range cpuModes {
+		total += delta[mode]
+	}
+	if total <= 0 {
+		for _, mode := range cpuModes {
+			usage.Modes[mode] = 0
+		}
+		return usage
+	}
+
+	for _, mode := range cpuModes {
+		usage.Modes[mode] = delta[mode] / total * 100
+	}
+	usage.Usage = 100 - usage.Modes["idle"] - usage.Modes["iowait"]
+	if usage.Usage < 0 {
+		usage.Usage = 0
+	}
+
+	return usage
+}
@@ -0,0 +1,47 @@
+package node_calc
+
+import (
+	"github.com/shirou/gopsutil/v3/cpu"
+	"math"
+	"testing"
+)
+
+func TestCPUSampler(t *testing.T) {
+	s := NewCPUSampler()
+
+	s.sample([]cpu.TimesStat{
+		{CPU: "cpu0", User: 100, System: 50, Idle: 800, Iowait: 50},
+		{CPU: "cpu1", User: 100, System: 50, Idle: 850},
+	})
+
+	// cpu0 busy 60% with 10% iowait, cpu1 idle, over 100s of each core
+	sample := s.sample([]cpu.TimesStat{
+		{CPU: "cpu0", User: 140, System: 70, Idle: 830, Iowait: 60},
+		{CPU: "cpu1", User: 100, System: 50, Idle: 950},
+	})
+
+	near := func(name string, got, want float64) {
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("%v = %v, want %v", name, got, want)
+		}
+	}
+	near("cpu0 usage", sample.PerCore["cpu0"].Usage, 60)
+	near("cpu0 iowait", sample.PerCore["cpu0"].Modes["iowait"], 10)
+	near("cpu0 user", sample.PerCore["cpu0"].Modes["user"], 40)
+	near("cpu1 usage", sample.PerCore["cpu1"].Usage, 0)
+	near("total usage", sample.Total.Usage, 30)
+	near("total steal", sample.Total.Modes["steal"], 0)
+
+	// a core whose counters went backwards starts from zero instead of reporting a negative delta
+	sample = s.sample([]cpu.TimesStat{
+		{CPU: "cpu0", User: 10, Idle: 30},
+		{CPU: "cpu1", User: 100, System: 50, Idle: 1050},
+	})
+	near("reset cpu0 usage", sample.PerCore["cpu0"].Usage, 25)
+
+	// no time elapsed
+	sample = s.sample([]cpu.TimesStat{
+		{CPU: "cpu0", User: 10, Idle: 30},
+	})
+	near("idle sampler usage", sample.PerCore["cpu0"].Usage, 0)
+}
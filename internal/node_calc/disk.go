@@ -0,0 +1,100 @@
+package node_calc
+
+import (
+	"github.com/shirou/gopsutil/v3/disk"
+	"sync"
+	"time"
+)
+
+// DiskRates are the disk health values of the time between two samples, like iostat -x
+type DiskRates struct {
+	UtilPercent  float64 // percent of the time the device had I/O in flight
+	AwaitMs      float64 // average time a read or write took, queueing included
+	ReadAwaitMs  float64
+	WriteAwaitMs float64
+	QueueDepth   float64 // average number of I/Os in flight
+}
+
+// DiskSampler calculates DiskRates from the difference between the io counters of two calls.
+// The first call has nothing to compare with and returns no rates
+type DiskSampler struct {
+	mu       sync.Mutex
+	last     map[string]disk.IOCountersStat
+	lastTime time.Time
+}
+
+// NewDiskSampler return a DiskSampler without a previous sample
+func NewDiskSampler() *DiskSampler {
+	return &DiskSampler{}
+}
+
+// Sample return the rates of every device since the previous call plus the aggregate of all of
+// them under "all": the average utilisation, the await of all operations and the summed queue.
+// A device whose counters went backwards is left out until the next call
+func (s *DiskSampler) Sample(counters map[string]disk.IOCountersStat, now time.Time) map[string]DiskRates {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, lastTime := s.last, s.lastTime
+	s.last, s.lastTime = counters, now
+
+	result := map[string]DiskRates{}
+	if last == nil {
+		return result
+	}
+
+	elapsedMs := float64(now.Sub(lastTime).Milliseconds())
+	if elapsedMs <= 0 {
+		return result
+	}
+
+	var all struct{ util, readTime, writeTime, reads, writes, weighted float64 }
+	for device, io := range counters {
+		before, ok := last[device]
+		if !ok || io.IoTime < before.IoTime || io.ReadCount < before.ReadCount || io.WriteCount < before.WriteCount ||
+			io.ReadTime < before.ReadTime || io.WriteTime < before.WriteTime || io.WeightedIO < before.WeightedIO {
+			continue
+		}
+
+		reads, writes := float64(io.ReadCount-before.ReadCount), float64(io.WriteCount-before.WriteCount)
+		readTime, writeTime := float64(io.ReadTime-before.ReadTime), float64(io.WriteTime-before.WriteTime)
+		util := float64(io.IoTime-before.IoTime) / elapsedMs * 100
+		if util > 100 {
+			util = 100
+		}
+		weighted := float64(io.WeightedIO - before.WeightedIO)
+
+		result[device] = DiskRates{
+			UtilPercent:  util,
+			AwaitMs:      ratio(readTime+writeTime, reads+writes),
+			ReadAwaitMs:  ratio(readTime, reads),
+			WriteAwaitMs: ratio(writeTime, writes),
+			QueueDepth:   weighted / elapsedMs,
+		}
+
+		all.util += util
+		all.readTime, all.writeTime = all.readTime+readTime, all.writeTime+writeTime
+		all.reads, all.writes = all.reads+reads, all.writes+writes
+		all.weighted += weighted
+	}
+
+	if len(result) > 0 {
+		result[aggregateLabel] = DiskRates{
+			UtilPercent:  all.util / float64(len(result)),
+			AwaitMs:      ratio(all.readTime+all.writeTime, all.reads+all.writes),
+			ReadAwaitMs:  ratio(all.readTime, all.reads),
+			WriteAwaitMs: ratio(all.writeTime, all.writes),
+			QueueDepth:   all.weighted / elapsedMs,
+		}
+	}
+
+	return result
+}
+
+func ratio(part, whole float64) float64 {
+	if whole == 0 {
+		return 0
+	}
+
+	return part / whole
+}
@@ -0,0 +1,48 @@
+package node_calc
+
+import (
+	"github.com/shirou/gopsutil/v3/disk"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDiskSampler(t *testing.T) {
+	s := NewDiskSampler()
+	start := time.Unix(1650000000, 0)
+
+	if rates := s.Sample(map[string]disk.IOCountersStat{
+		"vda": {ReadCount: 100, WriteCount: 100, ReadTime: 1000, WriteTime: 1000, IoTime: 5000, WeightedIO: 8000},
+		"vdb": {ReadCount: 10, IoTime: 100},
+	}, start); len(rates) != 0 {
+		t.Errorf("first sample returned rates %v", rates)
+	}
+
+	// over 10s vda was busy 5s with 100 reads of 2ms and 100 writes of 8ms
+	rates := s.Sample(map[string]disk.IOCountersStat{
+		"vda": {ReadCount: 200, WriteCount: 200, ReadTime: 1200, WriteTime: 1800, IoTime: 10000, WeightedIO: 18000},
+		"vdb": {ReadCount: 10, IoTime: 100},
+	}, start.Add(10*time.Second))
+
+	near := func(name string, got, want float64) {
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("%v = %v, want %v", name, got, want)
+		}
+	}
+	near("vda util", rates["vda"].UtilPercent, 50)
+	near("vda await", rates["vda"].AwaitMs, 5)
+	near("vda read await", rates["vda"].ReadAwaitMs, 2)
+	near("vda write await", rates["vda"].WriteAwaitMs, 8)
+	near("vda queue", rates["vda"].QueueDepth, 1)
+	near("vdb util", rates["vdb"].UtilPercent, 0)
+	near("all util", rates["all"].UtilPercent, 25)
+	near("all await", rates["all"].AwaitMs, 5)
+
+	// a device whose counters went backwards has no rates until the next sample
+	rates = s.Sample(map[string]disk.IOCountersStat{
+		"vda": {ReadCount: 1},
+	}, start.Add(20*time.Second))
+	if _, ok := rates["vda"]; ok {
+		t.Error("reset device reported rates")
+	}
+}
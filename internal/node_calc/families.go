@@ -0,0 +1,261 @@
+package node_calc
+
+import (
+	"fmt"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/util"
+	"strings"
+	"time"
+)
+
+// aggregateLabel is the device or mountpoint label value of the series summing every selected one
+const aggregateLabel = "all"
+
+// HostSampler keeps the previous CPU, disk and cgroup counters the host usage and rate metrics
+// are calculated from, every consumer of the host metrics needs its own
+type HostSampler struct {
+	cpu    *CPUSampler
+	disk   *DiskSampler
+	cgroup *CgroupSampler
+}
+
+// NewHostSampler return a HostSampler without previous samples
+func NewHostSampler() *HostSampler {
+	return &HostSampler{cpu: NewCPUSampler(), disk: NewDiskSampler(), cgroup: NewCgroupSampler("")}
+}
+
+// defaultHostSampler is the sampler of GetHostFamilies
+var defaultHostSampler = NewHostSampler()
+
+// GetHostFamilies return the host metrics of the default HostSampler
+func GetHostFamilies() (map[string]*prom2json.Family, error) {
+	return defaultHostSampler.Families()
+}
+
+// Families return the host metrics in the shape of scraped families, so the barad mapping
+// selects from them the same way it does from exporter metrics. Disk, mountpoint and
+// interface metrics have one series per selected device plus one labelled "all" aggregating
+// them. Every metric that can be read is returned, the error lists the ones that could not,
+// including configured devices the host does not have
+func (h *HostSampler) Families() (map[string]*prom2json.Family, error) {
+	result := map[string]*prom2json.Family{}
+	errs := []string{}
+
+	mountpoints, err := MountpointFilter()
+	if err != nil {
+		return result, err
+	}
+	disks, err := DiskFilter()
+	if err != nil {
+		return result, err
+	}
+	interfaces, err := InterfaceFilter()
+	if err != nil {
+		return result, err
+	}
+
+	perSecInfo, err := GetPerSecondMetric(mountpoints, h.cpu, h.cgroup)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("get node base info error: %v", err))
+	}
+	if perSecInfo != nil {
+		// the whole host keeps its unlabelled series, so a mapping summing the family does not add the cores
+		addFamily(result, "host_cpu_usage_percent", "GAUGE", nil, perSecInfo.CpuUsagePercent)
+		addCPUModes(result, "host_cpu_mode_percent", nil, perSecInfo.CpuSample.Total)
+		for core, usage := range perSecInfo.CpuSample.PerCore {
+			coreLabel := map[string]string{"cpu": strings.TrimPrefix(core, "cpu")}
+			addFamily(result, "host_cpu_core_usage_percent", "GAUGE", coreLabel, util.Decimal(usage.Usage, 2))
+			addCPUModes(result, "host_cpu_core_mode_percent", coreLabel, usage)
+		}
+		addFamily(result, "host_memory_used_bytes", "GAUGE", nil, float64(perSecInfo.MemoryUseState.Used))
+		addFamily(result, "host_memory_available_bytes", "GAUGE", nil, float64(perSecInfo.MemoryUseState.Available))
+		addFamily(result, "host_memory_total_bytes", "GAUGE", nil, float64(perSecInfo.MemoryUseState.Total))
+		addFamily(result, "host_memory_used_percent", "GAUGE", nil, perSecInfo.MemoryUsedPercent)
+
+		var used, total, inodesUsed, inodesTotal uint64
+		for _, usage := range perSecInfo.DiskUseStats {
+			mountLabel := map[string]string{"mountpoint": usage.Path}
+			addFamily(result, "host_disk_used_bytes", "GAUGE", mountLabel, float64(usage.Used))
+			addFamily(result, "host_disk_total_bytes", "GAUGE", mountLabel, float64(usage.Total))
+			addFamily(result, "host_disk_used_percent", "GAUGE", mountLabel, usage.UsedPercent)
+			addFamily(result, "host_disk_inodes_used_percent", "GAUGE", mountLabel, usage.InodesUsedPercent)
+
+			used, total = used+usage.Used, total+usage.Total
+			inodesUsed, inodesTotal = inodesUsed+usage.InodesUsed, inodesTotal+usage.InodesTotal
+		}
+
+		if perSecInfo.Cgroup != nil {
+			addCgroup(result, perSecInfo.Cgroup)
+		}
+
+		if len(perSecInfo.DiskUseStats) > 0 {
+			mountLabel := map[string]string{"mountpoint": aggregateLabel}
+			addFamily(result, "host_disk_used_bytes", "GAUGE", mountLabel, float64(used))
+			addFamily(result, "host_disk_total_bytes", "GAUGE", mountLabel, float64(total))
+			addFamily(result, "host_disk_used_percent", "GAUGE", mountLabel, percent(used, total))
+			addFamily(result, "host_disk_inodes_used_percent", "GAUGE", mountLabel, percent(inodesUsed, inodesTotal))
+		}
+	}
+
+	diskIOInfo, err := GetDiskRWAndIO(disks)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("get node disk read and write info error: %v", err))
+	}
+	if len(diskIOInfo) > 0 {
+		var all [6]uint64
+		for device, io := range diskIOInfo {
+			values := [6]uint64{io.ReadBytes, io.WriteBytes, io.ReadCount, io.WriteCount, io.MergedReadCount, io.MergedWriteCount}
+			addDiskIO(result, device, values)
+			for i := range all {
+				all[i] += values[i]
+			}
+		}
+		addDiskIO(result, aggregateLabel, all)
+
+		for device, rates := range h.disk.Sample(diskIOInfo, time.Now()) {
+			deviceLabel := map[string]string{"device": device}
+			addFamily(result, "host_disk_util_percent", "GAUGE", deviceLabel, util.Decimal(rates.UtilPercent, 2))
+			addFamily(result, "host_disk_await_ms", "GAUGE", deviceLabel, util.Decimal(rates.AwaitMs, 2))
+			addFamily(result, "host_disk_read_await_ms", "GAUGE", deviceLabel, util.Decimal(rates.ReadAwaitMs, 2))
+			addFamily(result, "host_disk_write_await_ms", "GAUGE", deviceLabel, util.Decimal(rates.WriteAwaitMs, 2))
+			addFamily(result, "host_disk_queue_depth", "GAUGE", deviceLabel, util.Decimal(rates.QueueDepth, 2))
+		}
+	}
+
+	netInfo, err := GetNetWorkInfo(interfaces)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("get node network info error: %v", err))
+	}
+	if len(netInfo) > 0 {
+		var all [8]uint64
+		for _, n := range netInfo {
+			values := [8]uint64{n.BytesSent, n.BytesRecv, n.PacketsSent, n.PacketsRecv, n.Errout, n.Errin, n.Dropout, n.Dropin}
+			addNetwork(result, n.Name, values)
+			for i := range all {
+				all[i] += values[i]
+			}
+		}
+		addNetwork(result, aggregateLabel, all)
+	}
+
+	tcpStat, err := GetTCPStat()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("get node tcp info error: %v", err))
+	} else {
+		for state, count := range tcpStat.States {
+			addFamily(result, "host_tcp_connections", "GAUGE", map[string]string{"state": state}, count)
+		}
+		for field, name := range tcpSNMPFamilies {
+			if value, ok := tcpStat.SNMP[field]; ok {
+				metricType := "COUNTER"
+				if field == "CurrEstab" {
+					metricType = "GAUGE"
+				}
+				addFamily(result, name, metricType, nil, value)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+
+	return result, nil
+}
+
+// addCPUModes add to the family called name the percent of time spent in every mode, by the
+// whole host or by the core in labels
+func addCPUModes(families map[string]*prom2json.Family, name string, labels map[string]string, usage CPUUsage) {
+	for mode, value := range usage.Modes {
+		modeLabels := map[string]string{"mode": mode}
+		for k, v := range labels {
+			modeLabels[k] = v
+		}
+		addFamily(families, name, "GAUGE", modeLabels, util.Decimal(value, 2))
+	}
+}
+
+// tcpSNMPFamilies are the host families of the Tcp fields of /proc/net/snmp
+var tcpSNMPFamilies = map[string]string{
+	"CurrEstab":    "host_tcp_curr_estab",
+	"ActiveOpens":  "host_tcp_active_opens_total",
+	"PassiveOpens": "host_tcp_passive_opens_total",
+	"InSegs":       "host_tcp_in_segs_total",
+	"OutSegs":      "host_tcp_out_segs_total",
+	"RetransSegs":  "host_tcp_retrans_segs_total",
+	"InErrs":       "host_tcp_in_errs_total",
+}
+
+// addDiskIO add the read bytes, written bytes, reads, writes, merged reads and merged writes of one device
+func addDiskIO(families map[string]*prom2json.Family, device string, values [6]uint64) {
+	deviceLabel := map[string]string{"device": device}
+	for i, name := range []string{"host_disk_read_bytes_total", "host_disk_written_bytes_total",
+		"host_disk_reads_completed_total", "host_disk_writes_completed_total",
+		"host_disk_reads_merged_total", "host_disk_writes_merged_total"} {
+		addFamily(families, name, "COUNTER", deviceLabel, float64(values[i]))
+	}
+}
+
+// addCgroup add the counters and limits of the cgroup the agent runs in, a limit is only
+// reported when there is one
+func addCgroup(families map[string]*prom2json.Family, stats *CgroupStats) {
+	addFamily(families, "host_cgroup_cpu_usage_seconds_total", "COUNTER", nil, stats.CPUUsageSeconds)
+	if stats.CPUQuotaCores > 0 {
+		addFamily(families, "host_cgroup_cpu_quota_cores", "GAUGE", nil, stats.CPUQuotaCores)
+	}
+	addFamily(families, "host_cgroup_cpu_periods_total", "COUNTER", nil, stats.Periods)
+	addFamily(families, "host_cgroup_cpu_throttled_periods_total", "COUNTER", nil, stats.ThrottledPeriods)
+	addFamily(families, "host_cgroup_cpu_throttled_seconds_total", "COUNTER", nil, stats.ThrottledSeconds)
+
+	addFamily(families, "host_cgroup_memory_usage_bytes", "GAUGE", nil, stats.MemoryUsage)
+	if stats.MemoryLimit > 0 {
+		addFamily(families, "host_cgroup_memory_limit_bytes", "GAUGE", nil, stats.MemoryLimit)
+	}
+	addFamily(families, "host_cgroup_oom_events_total", "COUNTER", nil, stats.OOMEvents)
+
+	for device, io := range stats.IO {
+		deviceLabel := map[string]string{"device": device}
+		addFamily(families, "host_cgroup_io_read_bytes_total", "COUNTER", deviceLabel, io.ReadBytes)
+		addFamily(families, "host_cgroup_io_written_bytes_total", "COUNTER", deviceLabel, io.WriteBytes)
+		addFamily(families, "host_cgroup_io_reads_total", "COUNTER", deviceLabel, io.Reads)
+		addFamily(families, "host_cgroup_io_writes_total", "COUNTER", deviceLabel, io.Writes)
+	}
+}
+
+// addNetwork add the byte, packet, error and drop counters of one interface
+func addNetwork(families map[string]*prom2json.Family, device string, values [8]uint64) {
+	interfaceLabel := map[string]string{"device": device}
+	for i, name := range []string{"host_network_transmit_bytes_total", "host_network_receive_bytes_total",
+		"host_network_transmit_packets_total", "host_network_receive_packets_total",
+		"host_network_transmit_errs_total", "host_network_receive_errs_total",
+		"host_network_transmit_drop_total", "host_network_receive_drop_total"} {
+		addFamily(families, name, "COUNTER", interfaceLabel, float64(values[i]))
+	}
+}
+
+func percent(part, whole uint64) float64 {
+	if whole == 0 {
+		return 0
+	}
+
+	return float64(part) / float64(whole) * 100
+}
+
+// addFamily add one series to the family called name, creating the family when needed
+func addFamily(families map[string]*prom2json.Family, name, metricType string, labels map[string]string, value float64) {
+	family, ok := families[name]
+	if !ok {
+		family = &prom2json.Family{Name: name, Type: metricType}
+		families[name] = family
+	}
+
+	seriesLabels := map[string]string{}
+	for k, v := range labels {
+		seriesLabels[k] = v
+	}
+
+	family.Metrics = append(family.Metrics, prom2json.Metric{
+		Labels: seriesLabels,
+		Value:  fmt.Sprint(value),
+	})
+}
@@ -0,0 +1,147 @@
+package node_calc
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Filter selects devices by name. A name is selected when it matches an include pattern, or
+// there is none, and matches no exclude pattern. Patterns are globs, or anchored regexes when
+// prefixed with ~. An include pattern without glob characters names one device, which is
+// reported missing when the host does not have it
+type Filter struct {
+	include  []pattern
+	exclude  []pattern
+	literals []string
+}
+
+type pattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+func (p pattern) match(name string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+	ok, _ := filepath.Match(p.glob, name)
+
+	return ok
+}
+
+// NewFilter compile the patterns of f, fallback is the include list used when f has none
+func NewFilter(f setting.HostFilter, fallback ...string) (*Filter, error) {
+	include := f.Include
+	if len(include) == 0 {
+		for _, name := range fallback {
+			if name != "" {
+				include = append(include, name)
+			}
+		}
+	}
+
+	filter := &Filter{}
+	for _, list := range []struct {
+		patterns []string
+		target   *[]pattern
+	}{{include, &filter.include}, {f.Exclude, &filter.exclude}} {
+		for _, p := range list.patterns {
+			compiled, err := compilePattern(p)
+			if err != nil {
+				return nil, err
+			}
+			*list.target = append(*list.target, compiled)
+		}
+	}
+
+	for _, p := range include {
+		if !strings.HasPrefix(p, "~") && !strings.ContainsAny(p, "*?[") {
+			filter.literals = append(filter.literals, p)
+		}
+	}
+
+	return filter, nil
+}
+
+func compilePattern(p string) (pattern, error) {
+	if strings.HasPrefix(p, "~") {
+		re, err := regexp.Compile("^(?:" + p[1:] + ")$")
+		if err != nil {
+			return pattern{}, fmt.Errorf("device pattern %q error: %v", p, err)
+		}
+		return pattern{regex: re}, nil
+	}
+
+	if _, err := filepath.Match(p, ""); err != nil {
+		return pattern{}, fmt.Errorf("device pattern %q error: %v", p, err)
+	}
+
+	return pattern{glob: p}, nil
+}
+
+// Empty report whether the filter has no include pattern, so it selects every device
+func (f *Filter) Empty() bool {
+	return len(f.include) == 0
+}
+
+// Match report whether name is selected
+func (f *Filter) Match(name string) bool {
+	for _, p := range f.exclude {
+		if p.match(name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p.match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing return the devices named literally by an include pattern that are not in names
+func (f *Filter) Missing(names []string) []string {
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+
+	missing := []string{}
+	for _, literal := range f.literals {
+		if !present[literal] {
+			missing = append(missing, literal)
+		}
+	}
+
+	return missing
+}
+
+// DiskFilter return the filter of global.devices.disks, falling back to global.disk
+func DiskFilter() (*Filter, error) {
+	f := setting.HostFilter{Exclude: global.GlobalSetting.Devices.Disks.Exclude}
+	for _, p := range global.GlobalSetting.Devices.Disks.Include {
+		f.Include = append(f.Include, strings.TrimPrefix(p, "/dev/"))
+	}
+
+	return NewFilter(f, strings.TrimPrefix(global.GlobalSetting.Disk, "/dev/"))
+}
+
+// MountpointFilter return the filter of global.devices.mountpoints, an empty include list
+// keeps the former choice of /data, or / when there is no /data
+func MountpointFilter() (*Filter, error) {
+	return NewFilter(global.GlobalSetting.Devices.Mountpoints)
+}
+
+// InterfaceFilter return the filter of global.devices.interfaces, falling back to global.net_interface
+func InterfaceFilter() (*Filter, error) {
+	return NewFilter(global.GlobalSetting.Devices.Interfaces, global.GlobalSetting.NetInterface)
+}
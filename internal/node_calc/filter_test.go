@@ -0,0 +1,46 @@
+package node_calc
+
+import (
+	"github.com/exporterpush/pkg/setting"
+	"reflect"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(setting.HostFilter{
+		Include: []string{"eth0", "bond*", "~ens[0-9]+", "eth9"},
+		Exclude: []string{"bond1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"lo", "eth0", "eth1", "bond0", "bond1", "ens3", "ens3a"}
+	selected := []string{}
+	for _, name := range names {
+		if f.Match(name) {
+			selected = append(selected, name)
+		}
+	}
+	if want := []string{"eth0", "bond0", "ens3"}; !reflect.DeepEqual(selected, want) {
+		t.Errorf("selected %v, want %v", selected, want)
+	}
+
+	if missing := f.Missing(names); !reflect.DeepEqual(missing, []string{"eth9"}) {
+		t.Errorf("missing %v, want [eth9]", missing)
+	}
+
+	fallback, _ := NewFilter(setting.HostFilter{Exclude: []string{"lo"}}, "eth0")
+	if !fallback.Match("eth0") || fallback.Match("eth1") || fallback.Empty() {
+		t.Error("fallback include not used")
+	}
+
+	all, _ := NewFilter(setting.HostFilter{Exclude: []string{"lo"}})
+	if !all.Match("eth1") || all.Match("lo") || !all.Empty() {
+		t.Error("a filter without include should select every device but the excluded")
+	}
+
+	if _, err := NewFilter(setting.HostFilter{Include: []string{"~("}}); err == nil {
+		t.Error("expected an error for a broken regex")
+	}
+}
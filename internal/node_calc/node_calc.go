@@ -1,79 +1,122 @@
 package node_calc
 
 import (
+	"fmt"
 	"github.com/exporterpush/pkg/util"
-	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
+	"strings"
 	"time"
 )
 
 type NodePerSecondMetric struct {
-	DiskUseStat       *disk.UsageStat
+	DiskUseStats      []*disk.UsageStat
 	CpuUsagePercent   float64
+	CpuSample         *CPUSample
 	MemoryUseState    *mem.VirtualMemoryStat
 	MemoryUsedPercent float64
+	Cgroup            *CgroupStats // nil outside a cgroup filesystem
 }
 
-// GetDiskUseInfo return "/data" partition usage info(used,free,total,usedPercent,inodesUsedPercent...)
-// if there is no "/ data" return "/"
-func GetDiskUseInfo() (*disk.UsageStat, error) {
-	diskPath := "/"
+// GetDiskUseInfo return the usage info(used,free,total,usedPercent,inodesUsedPercent...) of the
+// mountpoints selected by f. Without include patterns it is "/data", or "/" when there is no "/data".
+// The usage of every mountpoint found is returned, the error lists the ones that are not mounted
+// or could not be read
+func GetDiskUseInfo(f *Filter) ([]*disk.UsageStat, error) {
 	deviceDiskPartitons, err := disk.Partitions(false)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, partition := range deviceDiskPartitons {
-		if partition.Mountpoint == "/data" {
-			diskPath = partition.Mountpoint
+	mountpoints := []string{}
+	seen := map[string]bool{}
+	errs := []string{}
+	if f.Empty() {
+		mountpoints = append(mountpoints, "/")
+		for _, partition := range deviceDiskPartitons {
+			if partition.Mountpoint == "/data" {
+				mountpoints[0] = partition.Mountpoint
+			}
+		}
+	} else {
+		all := []string{}
+		for _, partition := range deviceDiskPartitons {
+			if seen[partition.Mountpoint] {
+				continue
+			}
+			seen[partition.Mountpoint] = true
+			all = append(all, partition.Mountpoint)
+
+			if f.Match(partition.Mountpoint) {
+				mountpoints = append(mountpoints, partition.Mountpoint)
+			}
 		}
-	}
 
-	partitionUsageInfo, err := disk.Usage(diskPath)
-	if err != nil {
-		return nil, err
+		if missing := f.Missing(all); len(missing) > 0 {
+			errs = append(errs, fmt.Sprintf("configured mountpoints %v are not mounted", missing))
+		}
 	}
 
-	return partitionUsageInfo, nil
-}
+	result := []*disk.UsageStat{}
+	for _, mountpoint := range mountpoints {
+		partitionUsageInfo, err := disk.Usage(mountpoint)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		result = append(result, partitionUsageInfo)
+	}
 
-func GetCpuUsage() (float64, error) {
-	cpuUsePercent, err := cpu.Percent(time.Second, false)
-	if err != nil {
-		return 0, err
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%v", strings.Join(errs, "; "))
 	}
 
-	return util.Decimal(cpuUsePercent[0], 2), nil
+	return result, nil
 }
 
-func GetPerSecondMetric() (*NodePerSecondMetric, error) {
+// GetPerSecondMetric return the host usage. When the agent runs in a container whose cgroup has a
+// CPU quota or a memory limit, the CPU and memory percent are against those limits. A
+// mountpoint that can not be read does not fail the rest, the usage is returned with the error
+func GetPerSecondMetric(mountpoints *Filter, cpuSampler *CPUSampler, cgroupSampler *CgroupSampler) (*NodePerSecondMetric, error) {
 	memInfo, err := mem.VirtualMemory()
 	if err != nil {
 		return nil, err
 	}
 
-	disUseInfo, err := GetDiskUseInfo()
+	disUseInfo, diskErr := GetDiskUseInfo(mountpoints)
+
+	cpuSample, err := cpuSampler.Sample()
 	if err != nil {
 		return nil, err
 	}
 
-	cpuUsage, err := GetCpuUsage()
+	cgroupStats, cgroupCpuPercent, cgroupCpuOK, err := cgroupSampler.Sample(time.Now())
 	if err != nil {
 		return nil, err
 	}
 
+	cpuUsePercent := cpuSample.Total.Usage
 	memUsePercent := 100 - ((float64(memInfo.Available) / float64(memInfo.Total)) * 100)
+	// the limits of a service cgroup on the host are the agent's own
+	container := cgroupStats != nil && cgroupStats.Container
+	if container && cgroupStats.CPUQuotaCores > 0 && cgroupCpuOK {
+		cpuUsePercent = cgroupCpuPercent
+	}
+	if container && cgroupStats.MemoryLimit > 0 {
+		memUsePercent = cgroupStats.MemoryUsage / cgroupStats.MemoryLimit * 100
+	}
 
 	nodeInfo := &NodePerSecondMetric{
-		DiskUseStat:       disUseInfo,
-		CpuUsagePercent:   cpuUsage,
+		DiskUseStats:      disUseInfo,
+		CpuUsagePercent:   util.Decimal(cpuUsePercent, 2),
+		CpuSample:         cpuSample,
 		MemoryUseState:    memInfo,
 		MemoryUsedPercent: util.Decimal(memUsePercent, 2),
+		Cgroup:            cgroupStats,
 	}
 
-	return nodeInfo, nil
+	return nodeInfo, diskErr
 }
 
 func GetMemUseInfo() (*mem.VirtualMemoryStat, error) {
@@ -86,29 +129,48 @@ func GetMemUseInfo() (*mem.VirtualMemoryStat, error) {
 	return memInfo, nil
 }
 
-func GetDiskRWAndIO(names string) (map[string]disk.IOCountersStat, error) {
+// GetDiskRWAndIO return the io counters of the disks selected by f
+func GetDiskRWAndIO(f *Filter) (map[string]disk.IOCountersStat, error) {
 
-	disk, err := disk.IOCounters(names)
+	disk, err := disk.IOCounters()
 	if err != nil {
 		return nil, err
 	}
 
+	names := []string{}
+	for name := range disk {
+		names = append(names, name)
+		if !f.Match(name) {
+			delete(disk, name)
+		}
+	}
+
+	if missing := f.Missing(names); len(missing) > 0 {
+		return disk, fmt.Errorf("configured disks %v are not found", missing)
+	}
+
 	return disk, nil
 }
 
-func GetNetWorkInfo(eth string) (*net.IOCountersStat, error) {
+// GetNetWorkInfo return the counters of the interfaces selected by f
+func GetNetWorkInfo(f *Filter) ([]net.IOCountersStat, error) {
 	netInfoList, err := net.IOCounters(true)
 	if err != nil {
 		return nil, err
 	}
 
-	var netInfo net.IOCountersStat
-
+	result := []net.IOCountersStat{}
+	names := []string{}
 	for _, net := range netInfoList {
-		if net.Name == eth {
-			netInfo = net
+		names = append(names, net.Name)
+		if f.Match(net.Name) {
+			result = append(result, net)
 		}
 	}
 
-	return &netInfo, nil
+	if missing := f.Missing(names); len(missing) > 0 {
+		return result, fmt.Errorf("configured interfaces %v are not found", missing)
+	}
+
+	return result, nil
 }
@@ -0,0 +1,136 @@
+package node_calc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpStates are the names of the connection states in /proc/net/tcp, by their hex code
+var tcpStates = map[string]string{
+	"01": "established",
+	"02": "syn_sent",
+	"03": "syn_recv",
+	"04": "fin_wait1",
+	"05": "fin_wait2",
+	"06": "time_wait",
+	"07": "close",
+	"08": "close_wait",
+	"09": "last_ack",
+	"0A": "listen",
+	"0B": "closing",
+}
+
+// procPath return the path of a file under /proc, or under $HOST_PROC like gopsutil does
+func procPath(elem ...string) string {
+	root := os.Getenv("HOST_PROC")
+	if root == "" {
+		root = "/proc"
+	}
+
+	return filepath.Join(append([]string{root}, elem...)...)
+}
+
+// ParseSNMP parse /proc/net/snmp, where every protocol has a header line of field names
+// followed by a line of values, e.g. result["Tcp"]["RetransSegs"]
+func ParseSNMP(r io.Reader) (map[string]map[string]float64, error) {
+	result := map[string]map[string]float64{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if len(names) == 0 {
+			continue
+		}
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("snmp %v has no value line", strings.TrimSuffix(names[0], ":"))
+		}
+		values := strings.Fields(scanner.Text())
+
+		if len(names) != len(values) || names[0] != values[0] {
+			return nil, fmt.Errorf("snmp header %q does not match values %q", names, values)
+		}
+
+		protocol := strings.TrimSuffix(names[0], ":")
+		result[protocol] = map[string]float64{}
+		for i := 1; i < len(names); i++ {
+			value, err := strconv.ParseFloat(values[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("snmp %v %v value %q error: %v", protocol, names[i], values[i], err)
+			}
+			result[protocol][names[i]] = value
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// ParseTCPStates count the connections of /proc/net/tcp or tcp6 into counts by state name
+func ParseTCPStates(r io.Reader, counts map[string]float64) error {
+	scanner := bufio.NewScanner(r)
+
+	header := true
+	for scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if state, ok := tcpStates[fields[3]]; ok {
+			counts[state]++
+		}
+	}
+
+	return scanner.Err()
+}
+
+// TCPStat is the TCP connection count by state and the TCP counters of /proc/net/snmp
+type TCPStat struct {
+	States map[string]float64
+	SNMP   map[string]float64
+}
+
+// GetTCPStat read the TCP connection states of IPv4 and IPv6 and the TCP snmp counters
+func GetTCPStat() (*TCPStat, error) {
+	stat := &TCPStat{States: map[string]float64{}}
+	for _, state := range tcpStates {
+		stat.States[state] = 0
+	}
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(procPath("net", name))
+		if err != nil {
+			if os.IsNotExist(err) && name == "tcp6" {
+				continue
+			}
+			return nil, err
+		}
+		err = ParseTCPStates(f, stat.States)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(procPath("net", "snmp"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snmp, err := ParseSNMP(f)
+	if err != nil {
+		return nil, err
+	}
+	stat.SNMP = snmp["Tcp"]
+
+	return stat, nil
+}
@@ -0,0 +1,77 @@
+package node_calc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSNMP = `Ip: Forwarding DefaultTTL InReceives
+Ip: 1 64 123456
+Tcp: RtoAlgorithm RtoMin RtoMax MaxConn ActiveOpens PassiveOpens AttemptFails EstabResets CurrEstab InSegs OutSegs RetransSegs InErrs OutRsts InCsumErrors
+Tcp: 1 200 120000 -1 3200 1500 10 20 42 900000 950000 321 7 100 0
+Udp: InDatagrams NoPorts InErrors OutDatagrams
+Udp: 10 0 0 12
+`
+
+const testTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:2328 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 20317 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:2328 0100007F:C7A6 01 00000000:00000000 00:00000000 00000000   101        0 20999 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:C7A6 0100007F:2328 01 00000000:00000000 00:00000000 00000000   101        0 21000 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:C7A8 0100007F:2328 06 00000000:00000000 03:00000D9E 00000000     0        0 0 3 0000000000000000
+`
+
+func TestParseSNMP(t *testing.T) {
+	snmp, err := ParseSNMP(strings.NewReader(testSNMP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{"CurrEstab": 42, "RetransSegs": 321, "OutSegs": 950000, "MaxConn": -1, "InErrs": 7}
+	for field, value := range want {
+		if snmp["Tcp"][field] != value {
+			t.Errorf("Tcp %v = %v, want %v", field, snmp["Tcp"][field], value)
+		}
+	}
+	if snmp["Udp"]["OutDatagrams"] != 12 {
+		t.Errorf("Udp OutDatagrams = %v, want 12", snmp["Udp"]["OutDatagrams"])
+	}
+
+	if _, err := ParseSNMP(strings.NewReader("Tcp: A B\nTcp: 1\n")); err == nil {
+		t.Error("expected an error for a value line shorter than its header")
+	}
+	if _, err := ParseSNMP(strings.NewReader("Tcp: A B\n")); err == nil {
+		t.Error("expected an error for a header without values")
+	}
+}
+
+func TestGetTCPStat(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"snmp": testSNMP, "tcp": testTCP, "tcp6": testTCP} {
+		if err := ioutil.WriteFile(filepath.Join(root, "net", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("HOST_PROC", root)
+	defer os.Unsetenv("HOST_PROC")
+
+	stat, err := GetTCPStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{"listen": 2, "established": 4, "time_wait": 2, "close_wait": 0}
+	for state, count := range want {
+		if stat.States[state] != count {
+			t.Errorf("%v connections = %v, want %v", state, stat.States[state], count)
+		}
+	}
+	if stat.SNMP["RetransSegs"] != 321 {
+		t.Errorf("RetransSegs = %v, want 321", stat.SNMP["RetransSegs"])
+	}
+}
@@ -2,13 +2,39 @@ package prometheus_push
 
 import (
 	"context"
+	"fmt"
 	"github.com/exporterpush/global"
-	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/internal/discovery"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/self_metrics"
+	"github.com/exporterpush/internal/stdout_push"
 	promclient "github.com/exporterpush/pkg/prometheus-remote-client"
 	"github.com/exporterpush/pkg/util"
+	"sync"
 	"time"
 )
 
+var (
+	destinations     *discovery.Destinations
+	destinationsErr  error
+	destinationsOnce sync.Once
+)
+
+// Destinations return the static destinations and the ones of destination_sd, tried in order
+// unless destination_sd sets fanout
+func Destinations() (*discovery.Destinations, error) {
+	destinationsOnce.Do(func() {
+		var static []string
+		if len(global.PrometheusSetting.StaticConfigs) > 0 {
+			static = global.PrometheusSetting.StaticConfigs[0].Destination
+		}
+		destinations, destinationsErr = discovery.NewDestinations(static, global.PrometheusSetting.DestinationSD,
+			discovery.ModeFailover, nil)
+	})
+
+	return destinations, destinationsErr
+}
+
 func PrometheusPush() {
 	defer util.CatchException(func(e interface{}) {
 		global.LogObj.Panic(e)
@@ -32,23 +58,49 @@ func push() {
 		global.LogObj.Panic(e)
 	})
 
-	prometheusSerAdd := global.PrometheusSetting.StaticConfigs[0].Destination[0]
+	begin := time.Now()
+	err := PushOnce()
+	self_metrics.ObserveCycle("prometheus", begin, err)
+	if err != nil {
+		global.LogObj.Error(err)
+	}
+}
 
-	cfg := promclient.NewConfig(promclient.WriteURLOption(prometheusSerAdd))
-	remoteWriteClient, err := promclient.NewClient(cfg)
+// PushOnce scrape node_exporter and the sources and remote write the points to the prometheus
+// servers one time
+func PushOnce() error {
+	dests, err := Destinations()
 	if err != nil {
-		global.LogObj.Errorf("new prometheus remote write client error:%v", err)
-		return
+		return fmt.Errorf("prometheus %v", err)
 	}
 
 	addLabel := global.PrometheusSetting.StaticConfigs[0].Labels
-	metricPointList := prom2json.GetProm2MetricPointList(global.GlobalSetting.ScrapeTargetTypes.NodeExporter, addLabel)
-
-	_, writeErr := remoteWriteClient.WriteMetricPointList(context.Background(), metricPointList, promclient.WriteOptions{})
-	if writeErr != nil {
-		global.LogObj.Errorf("remote write to prometheus server %v error:%v", prometheusSerAdd, writeErr.Error())
-		return
+	metricPointList, err := scrape.SinkMetricPointList(addLabel)
+	if err != nil {
+		return err
 	}
 
-	global.LogObj.Infof("remote write to %v success", prometheusSerAdd)
+	return dests.Send(func(numb int, prometheusSerAdd string) error {
+		if global.DryRun {
+			if err := stdout_push.PrintMetricPointList("prometheus", prometheusSerAdd, global.DryRunFormat, metricPointList); err != nil {
+				return fmt.Errorf("dry-run print prometheus payload error:%v", err)
+			}
+			return nil
+		}
+
+		cfg := promclient.NewConfig(promclient.WriteURLOption(prometheusSerAdd))
+		remoteWriteClient, err := promclient.NewClient(cfg)
+		if err != nil {
+			return fmt.Errorf("new prometheus remote write client error:%v", err)
+		}
+
+		_, writeErr := remoteWriteClient.WriteMetricPointList(context.Background(), metricPointList, promclient.WriteOptions{})
+		if writeErr != nil {
+			return fmt.Errorf("remote write to prometheus server %v error:%v", prometheusSerAdd, writeErr.Error())
+		}
+
+		global.LogObj.Infof("remote write to %v success", prometheusSerAdd)
+
+		return nil
+	})
 }
@@ -1,14 +1,48 @@
 package pushgateway_push
 
 import (
+	"fmt"
 	"github.com/exporterpush/global"
-	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/internal/discovery"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/self_metrics"
+	"github.com/exporterpush/internal/stdout_push"
+	"github.com/exporterpush/pkg/hostfacts"
 	"github.com/exporterpush/pkg/util"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"sort"
+	"sync"
 	"time"
 )
 
+const deleteTimeout = 10 * time.Second
+
+var (
+	destinations     *discovery.Destinations
+	destinationsErr  error
+	destinationsOnce sync.Once
+)
+
+// Destinations return the static destinations and the ones of destination_sd, all pushed to
+// unless destination_sd sets failover
+func Destinations() (*discovery.Destinations, error) {
+	destinationsOnce.Do(func() {
+		var static []string
+		if len(global.PushgatewaySetting.StaticConfigs) > 0 {
+			static = global.PushgatewaySetting.StaticConfigs[0].Destination
+		}
+		destinations, destinationsErr = discovery.NewDestinations(static, global.PushgatewaySetting.DestinationSD,
+			discovery.ModeFanout, nil)
+	})
+
+	return destinations, destinationsErr
+}
+
 func PushGatewayPush() {
 	defer util.CatchException(func(e interface{}) {
 		global.LogObj.Panic(e)
@@ -21,26 +55,178 @@ func PushGatewayPush() {
 	for {
 		select {
 		case <-ticker.C:
-			gather := prom2json.NewTransFormGather(global.GlobalSetting.ScrapeTargetTypes.NodeExporter)
+			begin := time.Now()
+			gather, err := gatherSnapshot()
+			if err != nil {
+				self_metrics.ObserveCycle("pushgateway", begin, err)
+				global.LogObj.Error(err)
+				continue
+			}
+
+			go func() {
+				defer util.CatchException(func(e interface{}) {
+					global.LogObj.Panic(e)
+				})
 
-			if len(global.PushgatewaySetting.StaticConfigs[0].Destination) >= 1 {
-				for key, destPushGateway := range global.PushgatewaySetting.StaticConfigs[0].Destination {
-					go pushInfo(key, destPushGateway, gather)
+				err := send(gather)
+				self_metrics.ObserveCycle("pushgateway", begin, err)
+				if err != nil {
+					global.LogObj.Error(err)
 				}
-			} else {
-				global.LogObj.Error("There is no push target when use PushGatewayPush")
-			}
+			}()
+		}
+	}
+
+}
 
+// PushGatewayPushOnce push the metric info of all scrape targets to the PushGateway destinations one time
+func PushGatewayPushOnce() error {
+	gather, err := gatherSnapshot()
+	if err != nil {
+		return err
+	}
+
+	return send(gather)
+}
+
+// send push the snapshot to every destination, or the first that accepts it in failover mode
+func send(gather prometheus.Gatherer) error {
+	dests, err := Destinations()
+	if err != nil {
+		return fmt.Errorf("pushgateway %v", err)
+	}
+
+	if err := dests.Send(func(numb int, dest string) error {
+		return pushInfo(numb, dest, gather)
+	}); err != nil {
+		return fmt.Errorf("PushGatewayPush %v", err)
+	}
+
+	return nil
+}
+
+// groupingKey return the rendered grouping key: the grouping setting when it is set,
+// otherwise the static labels as before the grouping setting existed
+func groupingKey() (map[string]string, error) {
+	labels := global.PushgatewaySetting.StaticConfigs[0].Labels
+
+	grouping := global.PushgatewaySetting.Grouping
+	if len(grouping) == 0 {
+		grouping = labels
+	}
+
+	rendered, err := hostfacts.RenderMap(grouping, labels)
+	if err != nil {
+		return nil, fmt.Errorf("render PushGateway grouping error:%v", err)
+	}
+
+	return rendered, nil
+}
+
+// gatherSnapshot gather every scrape target and the agent's own collectors once so all
+// destinations receive the same snapshot. The static labels are injected into every series,
+// except the ones in the grouping key which the PushGateway attaches itself and refuses in pushed series
+func gatherSnapshot() (scrape.Snapshot, error) {
+	labels := global.PushgatewaySetting.StaticConfigs[0].Labels
+	rendered, err := hostfacts.RenderMap(labels, labels)
+	if err != nil {
+		return nil, fmt.Errorf("render PushGateway labels error:%v", err)
+	}
+
+	grouping, err := groupingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	injectLabels := map[string]string{}
+	for k, v := range rendered {
+		if _, ok := grouping[k]; !ok {
+			injectLabels[k] = v
 		}
 	}
 
+	families, err := scrape.NewGatherer(injectLabels).Gather()
+	if len(families) == 0 {
+		return nil, fmt.Errorf("PushGatewayPush gathered no metric family, error:%v", err)
+	}
+	if err != nil {
+		global.LogObj.Warnf("PushGatewayPush gather metric info partially failed:%v", err)
+	}
+
+	grouping["job"] = ""
+	exportGroupingLabels(families, grouping)
+
+	return scrape.Snapshot(families), nil
 }
 
-func pushInfo(numb int, dest string, g prometheus.Gatherer) {
-	defer util.CatchException(func(e interface{}) {
-		global.LogObj.Panic(e)
-	})
+// exportGroupingLabels rename the job and grouping labels of the series, as carried by discovered
+// targets and received or pushed groups, to exported_<name> like Prometheus does on a conflict,
+// since the PushGateway refuses series with the labels it attaches itself
+func exportGroupingLabels(families []*dto.MetricFamily, grouping map[string]string) {
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			renamed := false
+			for _, l := range m.Label {
+				if _, ok := grouping[l.GetName()]; ok {
+					l.Name = proto.String(model.ExportedLabelPrefix + l.GetName())
+					renamed = true
+				}
+			}
+			if renamed {
+				sort.Slice(m.Label, func(i, j int) bool {
+					return m.Label[i].GetName() < m.Label[j].GetName()
+				})
+			}
+		}
+	}
+}
 
+// PushGatewayDelete delete the pushed group from every PushGateway destination, it is called
+// on graceful shutdown when delete_on_shutdown is set so a decommissioned host leaves no stale metrics
+func PushGatewayDelete() error {
+	if !global.PushgatewaySetting.DeleteOnShutdown {
+		return nil
+	}
+
+	dests, err := Destinations()
+	if err != nil {
+		return fmt.Errorf("pushgateway %v", err)
+	}
+
+	// a failover destination may hold the group from an earlier push, so delete it everywhere
+	var errs []error
+	for _, dest := range dests.List() {
+		pusher, job_name, grouping, err := newPusher(dest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if global.DryRun {
+			if err := stdout_push.PrintJSON("pushgateway",
+				fmt.Sprintf("%v job=%v grouping=%v", dest, job_name, grouping), []byte(`{"method":"DELETE"}`)); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if err := pusher.Client(&http.Client{Timeout: deleteTimeout}).Delete(); err != nil {
+			errs = append(errs, fmt.Errorf("delete group job=%v grouping=%v from PushGateway %v error:%v", job_name, grouping, dest, err))
+			continue
+		}
+
+		global.LogObj.Infof("delete group job=%v grouping=%v from PushGateway %v success", job_name, grouping, dest)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	return nil
+}
+
+// newPusher return the pusher of dest with the job name and the rendered grouping key
+func newPusher(dest string) (*push.Pusher, string, map[string]string, error) {
 	var job_name string
 
 	if global.PushgatewaySetting.JobnName != "" {
@@ -49,18 +235,52 @@ func pushInfo(numb int, dest string, g prometheus.Gatherer) {
 		job_name = "exporter_push"
 	}
 
-	push := push.New(dest, job_name)
+	grouping, err := groupingKey()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	pusher := push.New(dest, job_name)
+	for labelKey, labelValue := range grouping {
+		pusher.Grouping(labelKey, labelValue)
+	}
 
-	if len(global.PushgatewaySetting.StaticConfigs[0].Labels) > 0 {
-		for labelKey, labelValue := range global.PushgatewaySetting.StaticConfigs[0].Labels {
-			push.Grouping(labelKey, labelValue)
+	return pusher, job_name, grouping, nil
+}
+
+func pushInfo(numb int, dest string, g prometheus.Gatherer) error {
+	pusher, job_name, grouping, err := newPusher(dest)
+	if err != nil {
+		return err
+	}
+
+	if global.DryRun {
+		families, err := g.Gather()
+		if err != nil {
+			return fmt.Errorf("PushGatewayPush goroutine %v gather metric info error:%v", numb, err)
+		}
+		if err := stdout_push.PrintMetricFamilies("pushgateway",
+			fmt.Sprintf("%v method=%v job=%v grouping=%v", dest, global.PushgatewaySetting.Method, job_name, grouping),
+			global.DryRunFormat, families); err != nil {
+			return fmt.Errorf("dry-run print pushgateway payload error:%v", err)
 		}
+		return nil
 	}
 
-	if err := push.Gatherer(g).Push(); err != nil {
-		global.LogObj.Errorf("PushGatewayPush goroutine %v Could not push to PushGateway %v,error:%v", numb, dest, err)
+	pusher.Gatherer(g)
+
+	// put replaces the whole group, post only replaces the metrics with the same name
+	if global.PushgatewaySetting.Method == "post" {
+		err = pusher.Add()
 	} else {
-		global.LogObj.Infof("PushGatewayPush goroutine %v push monitor info to PushGateway %v success !",
-			numb, dest)
+		err = pusher.Push()
+	}
+	if err != nil {
+		return fmt.Errorf("PushGatewayPush goroutine %v Could not push to PushGateway %v,error:%v", numb, dest, err)
 	}
+
+	global.LogObj.Infof("PushGatewayPush goroutine %v push monitor info to PushGateway %v success !",
+		numb, dest)
+
+	return nil
 }
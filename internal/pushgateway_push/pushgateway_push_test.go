@@ -2,8 +2,10 @@ package pushgateway_push
 
 import (
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
 	"testing"
 )
 
@@ -38,3 +40,24 @@ func TestPushgateway(t *testing.T) {
 	//	fmt.Println("Could not push to Pushgateway:", err)
 	//}
 }
+
+func TestExportGroupingLabels(t *testing.T) {
+	families := []*dto.MetricFamily{{
+		Name: proto.String("backup_ok"),
+		Metric: []*dto.Metric{{Label: []*dto.LabelPair{
+			{Name: proto.String("instance"), Value: proto.String("db1")},
+			{Name: proto.String("job"), Value: proto.String("backup")},
+			{Name: proto.String("kind"), Value: proto.String("full")},
+		}}},
+	}}
+
+	exportGroupingLabels(families, map[string]string{"job": "", "instance": "host1"})
+
+	got := ""
+	for _, l := range families[0].Metric[0].Label {
+		got += l.GetName() + "=" + l.GetValue() + ","
+	}
+	if want := "exported_instance=db1,exported_job=backup,kind=full,"; got != want {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PushPath prefixes the Pushgateway API paths, /metrics/job/<job>{/<label>/<value>}
+	PushPath = "/metrics/"
+
+	pushTimeName = "push_time_seconds"
+
+	// maxGroups bounds the groups held, a push of a new group beyond it is refused
+	maxGroups = 10000
+)
+
+// errTooManyGroups refuses a push of a new group when maxGroups are held already
+var errTooManyGroups = fmt.Errorf("more than %v groups pushed, delete some first", maxGroups)
+
+// GroupStore holds the groups pushed through the Pushgateway API and gathers their metrics
+// with the grouping labels attached, plus push_time_seconds of every group. With a
+// persistence file the groups survive a restart
+type GroupStore struct {
+	file string
+
+	mu     sync.Mutex
+	groups map[string]*pushedGroup
+	dirty  bool
+}
+
+// pushedGroup is one group, Families hold the grouping labels already
+type pushedGroup struct {
+	Labels   map[string]string            `json:"labels"`
+	Families map[string]*dto.MetricFamily `json:"-"`
+	PushTime time.Time                    `json:"push_time"`
+	Text     string                       `json:"metrics"` // text exposition of Families, only in the persistence file
+}
+
+// NewGroupStore return a GroupStore persisted to file, loading the groups it holds. An empty
+// file keeps the groups in memory only. A file that can not be loaded is an error, so it is
+// not overwritten by the next save
+func NewGroupStore(file string) (*GroupStore, error) {
+	s := &GroupStore{file: file, groups: map[string]*pushedGroup{}}
+	if file == "" {
+		return s, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*pushedGroup{}
+	if err := json.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("read pushed groups %v error: %v", file, err)
+	}
+	for _, g := range groups {
+		families, err := parseFamilies(strings.NewReader(g.Text), expfmt.FmtText)
+		if err != nil {
+			return nil, fmt.Errorf("read pushed group %v of %v error: %v", g.Labels, file, err)
+		}
+		g.Families, g.Text = families, ""
+		s.groups[groupKey(g.Labels)] = g
+	}
+
+	return s, nil
+}
+
+// Push store the families of the group with labels, replacing the whole group or, when
+// replace is false, only the families of the same names. A series with a grouping label of
+// another value is refused, as is a new group when maxGroups are held
+func (s *GroupStore) Push(labels map[string]string, families map[string]*dto.MetricFamily, replace bool) error {
+	for name, mf := range families {
+		if name == pushTimeName {
+			return fmt.Errorf("metric %v is set by the agent and can not be pushed", name)
+		}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if value, ok := labels[l.GetName()]; ok && l.GetValue() != "" && l.GetValue() != value {
+					return fmt.Errorf("metric %v label %v=%q conflicts with the grouping label %q", name, l.GetName(), l.GetValue(), value)
+				}
+			}
+			setLabels(m, labels)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := groupKey(labels)
+	g, ok := s.groups[key]
+	if !ok && len(s.groups) >= maxGroups {
+		return errTooManyGroups
+	}
+	if !ok || replace {
+		g = &pushedGroup{Labels: labels, Families: map[string]*dto.MetricFamily{}}
+		s.groups[key] = g
+	}
+	for name, mf := range families {
+		g.Families[name] = mf
+	}
+	g.PushTime = time.Now()
+	s.dirty = true
+
+	return nil
+}
+
+// Delete remove the group with labels
+func (s *GroupStore) Delete(labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.groups, groupKey(labels))
+	s.dirty = true
+}
+
+func (s *GroupStore) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.groups))
+	for key := range s.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// the same family pushed by several groups is merged, the first type wins
+	merged := map[string]*dto.MetricFamily{}
+	pushTime := &dto.MetricFamily{
+		Name: proto.String(pushTimeName),
+		Help: proto.String("Last Unix time when the group was pushed to the agent."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, key := range keys {
+		g := s.groups[key]
+		for name, mf := range g.Families {
+			result, ok := merged[name]
+			if !ok {
+				result = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				merged[name] = result
+			}
+			if result.GetType() != mf.GetType() {
+				global.LogObj.Warnf("pushed metric %v of group %v is %v, not %v as in another group, left out",
+					name, g.Labels, mf.GetType(), result.GetType())
+				continue
+			}
+			// the gathered series get the labels of the sinks injected, the stored ones must not
+			for _, m := range mf.Metric {
+				result.Metric = append(result.Metric, proto.Clone(m).(*dto.Metric))
+			}
+		}
+
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(float64(g.PushTime.UnixNano()) / 1e9)}}
+		setLabels(m, g.Labels)
+		pushTime.Metric = append(pushTime.Metric, m)
+	}
+	if len(pushTime.Metric) > 0 {
+		merged[pushTimeName] = pushTime
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		result = append(result, merged[name])
+	}
+
+	return result, nil
+}
+
+// Save write the groups to the persistence file when they changed since the last save
+func (s *GroupStore) Save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.groups))
+	for key := range s.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	groups := []*pushedGroup{}
+	for _, key := range keys {
+		g := s.groups[key]
+		names := make([]string, 0, len(g.Families))
+		for name := range g.Families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf := &bytes.Buffer{}
+		for _, name := range names {
+			if _, err := expfmt.MetricFamilyToText(buf, g.Families[name]); err != nil {
+				return err
+			}
+		}
+		groups = append(groups, &pushedGroup{Labels: g.Labels, PushTime: g.PushTime, Text: buf.String()})
+	}
+
+	content, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+	// a crash while writing must not leave a truncated file behind
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+	s.dirty = false
+
+	return nil
+}
+
+// NewPushHandler return the handler of the Pushgateway API: PUT replaces a group, POST
+// replaces the pushed metric names of a group, DELETE removes a group. Payloads are in the
+// text exposition format or, as the Content-Type says, the delimited protobuf format that
+// the client_golang pusher sends
+func NewPushHandler(store *GroupStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels, err := ParseGroupingPath(strings.TrimPrefix(r.URL.Path, PushPath))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWriteBytes))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("read body error: %v", err), http.StatusRequestEntityTooLarge)
+				return
+			}
+			families, err := parseFamilies(bytes.NewReader(body), expfmt.ResponseFormat(r.Header))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.Push(labels, families, r.Method == http.MethodPut); err != nil {
+				code := http.StatusBadRequest
+				if err == errTooManyGroups {
+					code = http.StatusTooManyRequests
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			store.Delete(labels)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Header().Set("Allow", "PUT, POST, DELETE")
+			http.Error(w, "only PUT, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ParseGroupingPath return the grouping labels of job/<job>{/<label>/<value>}, a label
+// name suffixed with @base64 has a base64url encoded value, as the Pushgateway accepts
+func ParseGroupingPath(path string) (map[string]string, error) {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("path %q is not job/<job>{/<label>/<value>}", path)
+	}
+
+	labels := map[string]string{}
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("label %v value %q is not base64url: %v", name, value, err)
+			}
+			value = string(decoded)
+		}
+		if i == 0 && name != "job" {
+			return nil, fmt.Errorf("path %q does not start with job", path)
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("label name %q is not valid", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %v is given twice", name)
+		}
+		labels[name] = value
+	}
+	if labels["job"] == "" {
+		return nil, fmt.Errorf("job is empty")
+	}
+
+	return labels, nil
+}
+
+// parseFamilies parse the delimited protobuf format, anything else as the text format
+func parseFamilies(in io.Reader, format expfmt.Format) (map[string]*dto.MetricFamily, error) {
+	if format == expfmt.FmtProtoDelim {
+		families := map[string]*dto.MetricFamily{}
+		decoder := expfmt.NewDecoder(in, format)
+		for {
+			mf := &dto.MetricFamily{}
+			if err := decoder.Decode(mf); err == io.EOF {
+				return families, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if existing, ok := families[mf.GetName()]; ok {
+				existing.Metric = append(existing.Metric, mf.Metric...)
+				continue
+			}
+			families[mf.GetName()] = mf
+		}
+	}
+
+	mfChan := make(chan *dto.MetricFamily, 1024)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- prom2json.ParseReader(in, mfChan)
+	}()
+
+	families := map[string]*dto.MetricFamily{}
+	for mf := range mfChan {
+		families[mf.GetName()] = mf
+	}
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
+
+// setLabels set the labels missing or empty in m and keep the label pairs sorted
+func setLabels(m *dto.Metric, labels map[string]string) {
+	present := map[string]*dto.LabelPair{}
+	for _, l := range m.Label {
+		present[l.GetName()] = l
+	}
+	for name, value := range labels {
+		if l, ok := present[name]; ok {
+			l.Value = proto.String(value)
+			continue
+		}
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(m.Label, func(i, j int) bool {
+		return m.Label[i].GetName() < m.Label[j].GetName()
+	})
+}
+
+func groupKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := ""
+	for _, name := range names {
+		key += name + "\xff" + labels[name] + "\xff"
+	}
+
+	return key
+}
@@ -0,0 +1,204 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func request(t *testing.T, method, url, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// values gather store into family name and sorted label values to value
+func values(t *testing.T, store *GroupStore) map[string]float64 {
+	families, err := store.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetName() == pushTimeName {
+			continue
+		}
+		for _, m := range mf.Metric {
+			key := mf.GetName()
+			for _, l := range m.Label {
+				key += "," + l.GetName() + "=" + l.GetValue()
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				result[key] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				result[key] = m.GetGauge().GetValue()
+			default:
+				result[key] = m.GetUntyped().GetValue()
+			}
+		}
+	}
+
+	return result
+}
+
+func TestPushHandler(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	store, err := NewGroupStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(PushPath, NewPushHandler(store))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	backup := server.URL + "/metrics/job/backup/instance/db1"
+	if code := request(t, http.MethodPut, backup, "# TYPE backup_ok gauge\nbackup_ok 1\nbackup_bytes 100\n"); code != http.StatusOK {
+		t.Fatalf("put status = %v", code)
+	}
+	// post replaces backup_bytes only
+	if code := request(t, http.MethodPost, backup, "backup_bytes 200\n"); code != http.StatusOK {
+		t.Fatalf("post status = %v", code)
+	}
+	// the path of the value is base64url encoded
+	if code := request(t, http.MethodPut, server.URL+"/metrics/job/cron/path@base64/L3Zhci90bXA", "cron_ok 1\n"); code != http.StatusOK {
+		t.Fatalf("put base64 status = %v", code)
+	}
+
+	got := values(t, store)
+	for key, want := range map[string]float64{
+		"backup_ok,instance=db1,job=backup":    1,
+		"backup_bytes,instance=db1,job=backup": 200,
+		"cron_ok,job=cron,path=/var/tmp":       1,
+	} {
+		if got[key] != want {
+			t.Errorf("%v = %v, want %v in %v", key, got[key], want, got)
+		}
+	}
+
+	// put replaces the whole group
+	request(t, http.MethodPut, backup, "backup_bytes 300\n")
+	if _, ok := values(t, store)["backup_ok,instance=db1,job=backup"]; ok {
+		t.Error("backup_ok left after put")
+	}
+
+	if code := request(t, http.MethodDelete, backup, ""); code != http.StatusAccepted {
+		t.Fatalf("delete status = %v", code)
+	}
+	if got := values(t, store); len(got) != 1 {
+		t.Errorf("values = %v, want the cron group only", got)
+	}
+	families, _ := store.Gather()
+	if families[len(families)-1].GetName() != pushTimeName || len(families[len(families)-1].Metric) != 1 {
+		t.Errorf("families = %v, want push_time_seconds of the cron group", families)
+	}
+
+	for _, c := range []struct{ method, path, body string }{
+		{http.MethodPut, "/metrics/job/a", "not a metric\n"},
+		{http.MethodPut, "/metrics/job/a", "x{job=\"b\"} 1\n"},
+		{http.MethodPut, "/metrics/job/a", "push_time_seconds 1\n"},
+		{http.MethodPut, "/metrics/instance/a", "x 1\n"},
+		{http.MethodPut, "/metrics/job/a/instance", "x 1\n"},
+		{http.MethodPut, "/metrics/job/a/__name__/b", "x 1\n"},
+	} {
+		if code := request(t, c.method, server.URL+c.path, c.body); code != http.StatusBadRequest {
+			t.Errorf("%v %v %q status = %v, want 400", c.method, c.path, c.body, code)
+		}
+	}
+}
+
+func TestPushHandlerClient(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	store, err := NewGroupStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(PushPath, NewPushHandler(store))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the client_golang pusher sends the delimited protobuf format
+	completed := prometheus.NewGauge(prometheus.GaugeOpts{Name: "job_completed", Help: "h"})
+	completed.Set(42)
+	if err := push.New(server.URL, "job").Grouping("instance", "db1").Collector(completed).Push(); err != nil {
+		t.Fatal(err)
+	}
+	if got := values(t, store); got["job_completed,instance=db1,job=job"] != 42 {
+		t.Errorf("values = %v, want job_completed 42 of the pushed group", got)
+	}
+
+	large := strings.Repeat("x", maxWriteBytes+1)
+	if code := request(t, http.MethodPut, server.URL+"/metrics/job/a", large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body status = %v, want 413", code)
+	}
+}
+
+func TestGroupStoreMaxGroups(t *testing.T) {
+	store, _ := NewGroupStore("")
+	for i := 0; i < maxGroups; i++ {
+		store.groups[fmt.Sprint(i)] = &pushedGroup{}
+	}
+
+	families, _ := parseFamilies(strings.NewReader("x 1\n"), expfmt.FmtText)
+	if err := store.Push(map[string]string{"job": "new"}, families, true); err != errTooManyGroups {
+		t.Errorf("push beyond max groups error = %v, want %v", err, errTooManyGroups)
+	}
+}
+
+func TestGroupStorePersistence(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	file := filepath.Join(t.TempDir(), "pushed", "groups.json")
+
+	store, err := NewGroupStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families, err := parseFamilies(strings.NewReader("# TYPE jobs_total counter\njobs_total{kind=\"a\"} 3\n"), expfmt.FmtText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Push(map[string]string{"job": "batch"}, families, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewGroupStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values(t, loaded); got["jobs_total,job=batch,kind=a"] != 3 {
+		t.Errorf("values = %v, want jobs_total 3 of the saved group", got)
+	}
+
+	// a corrupt file is an error, not a partly loaded store that overwrites it on save
+	if err := ioutil.WriteFile(file, []byte(`[{"labels":{"job":"a"},"metrics":"x{"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGroupStore(file); err == nil {
+		t.Error("corrupt persistence file loaded without error")
+	}
+}
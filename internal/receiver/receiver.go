@@ -0,0 +1,209 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxAge is how long a series is pushed on after it was last received, the
+	// staleness period of Prometheus
+	DefaultMaxAge = 5 * time.Minute
+
+	// WritePath is where remote write requests are accepted
+	WritePath = "/api/v1/write"
+
+	maxWriteBytes   = 32 << 20
+	maxDecodedBytes = 256 << 20
+)
+
+// Store keeps the last value of every series received by remote write and gathers them as
+// untyped families, so they reach the sinks like scraped series. A series not received again
+// within maxAge is dropped
+type Store struct {
+	relabel []*relabel.Config
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	series map[uint64]*storedSeries
+}
+
+type storedSeries struct {
+	labels    labels.Labels
+	value     float64
+	timestamp int64 // of the sample, in milliseconds
+	updated   time.Time
+}
+
+// NewStore return a Store relabeling the received series with relabelConfigs, maxAge of 0
+// is DefaultMaxAge
+func NewStore(relabelConfigs []*relabel.Config, maxAge time.Duration) *Store {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+
+	return &Store{relabel: relabelConfigs, maxAge: maxAge, series: map[uint64]*storedSeries{}}
+}
+
+// Append store the newest sample of every series of req, series dropped by relabeling or
+// without a valid name are skipped, as is a sample older than the stored one, so a retried
+// request does not move a counter backwards. A staleness marker removes the series. It returns
+// the number of series stored
+func (s *Store) Append(req *prompb.WriteRequest) int {
+	now := time.Now()
+	stored := 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ts := range req.Timeseries {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		sample := ts.Samples[0]
+		for _, sm := range ts.Samples[1:] {
+			if sm.Timestamp >= sample.Timestamp {
+				sample = sm
+			}
+		}
+
+		lset := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		sort.Sort(lset)
+		lset = relabel.Process(lset, s.relabel...)
+		if lset == nil || !model.IsValidMetricName(model.LabelValue(lset.Get(labels.MetricName))) {
+			continue
+		}
+
+		hash := lset.Hash()
+		if old, ok := s.series[hash]; ok && sample.Timestamp < old.timestamp {
+			continue
+		}
+		if value.IsStaleNaN(sample.Value) {
+			delete(s.series, hash)
+			continue
+		}
+
+		s.series[hash] = &storedSeries{labels: lset, value: sample.Value, timestamp: sample.Timestamp, updated: now}
+		stored++
+	}
+
+	return stored
+}
+
+func (s *Store) Gather() ([]*dto.MetricFamily, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	families := map[string]*dto.MetricFamily{}
+	for hash, series := range s.series {
+		if now.Sub(series.updated) > s.maxAge {
+			delete(s.series, hash)
+			continue
+		}
+
+		name := series.labels.Get(labels.MetricName)
+		mf, ok := families[name]
+		if !ok {
+			mf = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+			families[name] = mf
+		}
+
+		m := &dto.Metric{Untyped: &dto.Untyped{Value: proto.Float64(series.value)}}
+		for _, l := range series.labels {
+			if l.Name != labels.MetricName {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+			}
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		mf := families[name]
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return labelString(mf.Metric[i]) < labelString(mf.Metric[j])
+		})
+		result = append(result, mf)
+	}
+
+	return result, nil
+}
+
+func labelString(m *dto.Metric) string {
+	result := ""
+	for _, l := range m.Label {
+		result += l.GetName() + "=" + l.GetValue() + ","
+	}
+
+	return result
+}
+
+// NewWriteHandler return the handler of Prometheus remote write requests, snappy compressed
+// prompb.WriteRequest bodies, storing the series into store
+func NewWriteHandler(store *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, err := decodeWriteRequest(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		store.Append(req)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func decodeWriteRequest(body io.Reader) (*prompb.WriteRequest, error) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(body, maxWriteBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > maxWriteBytes {
+		return nil, fmt.Errorf("request body is larger than %v bytes", maxWriteBytes)
+	}
+
+	if n, err := snappy.DecodedLen(compressed); err == nil && n > maxDecodedBytes {
+		return nil, fmt.Errorf("decoded request body is larger than %v bytes", maxDecodedBytes)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decode error: %v", err)
+	}
+
+	req := &prompb.WriteRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("unmarshal write request error: %v", err)
+	}
+
+	return req, nil
+}
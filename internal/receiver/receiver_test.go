@@ -0,0 +1,154 @@
+package receiver
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func series(value float64, timestamp int64, nameValues ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}}}
+	for i := 0; i < len(nameValues); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: nameValues[i], Value: nameValues[i+1]})
+	}
+
+	return ts
+}
+
+func post(t *testing.T, url string, req *prompb.WriteRequest) int {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestWriteHandler(t *testing.T) {
+	relabelConfigs := []*relabel.Config{}
+	if err := yaml.UnmarshalStrict([]byte(`
+- source_labels: [__name__]
+  regex: debug_.*
+  action: drop
+- target_label: relay
+  replacement: edge
+`), &relabelConfigs); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(relabelConfigs, 0)
+	server := httptest.NewServer(NewWriteHandler(store))
+	defer server.Close()
+
+	ts := series(1, 1000, "__name__", "app_requests_total", "path", "/b")
+	ts.Samples = append(ts.Samples, prompb.Sample{Value: 5, Timestamp: 2000}, prompb.Sample{Value: 3, Timestamp: 1500})
+	code := post(t, server.URL, &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		ts,
+		series(7, 1000, "path", "/a", "__name__", "app_requests_total"),
+		series(9, 1000, "__name__", "debug_info"),
+		series(9, 1000, "job", "no_name"),
+	}})
+	if code != http.StatusNoContent {
+		t.Fatalf("status = %v, want 204", code)
+	}
+	post(t, server.URL, &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		series(8, 3000, "__name__", "app_requests_total", "path", "/a"),
+	}})
+
+	families, err := store.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "app_requests_total" || len(families[0].Metric) != 2 {
+		t.Fatalf("families = %v, want app_requests_total with 2 series", families)
+	}
+	for i, want := range []struct {
+		path  string
+		value float64
+	}{{"/a", 8}, {"/b", 5}} {
+		m := families[0].Metric[i]
+		if m.Label[0].GetValue() != want.path || m.Label[1].GetName() != "relay" || m.GetUntyped().GetValue() != want.value {
+			t.Errorf("series %v = %v, want path %v with relay label and value %v", i, m, want.path, want.value)
+		}
+	}
+}
+
+func TestWriteHandlerError(t *testing.T) {
+	server := httptest.NewServer(NewWriteHandler(NewStore(nil, 0)))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader([]byte("not snappy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %v, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status = %v, want 405", resp.StatusCode)
+	}
+}
+
+func TestStoreMaxAge(t *testing.T) {
+	store := NewStore(nil, 50*time.Millisecond)
+	store.Append(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{series(1, 1000, "__name__", "up")}})
+	if families, _ := store.Gather(); len(families) != 1 {
+		t.Fatalf("families = %v, want up", families)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if families, _ := store.Gather(); len(families) != 0 {
+		t.Errorf("families = %v, want none after max_age", families)
+	}
+}
+
+func TestStoreOutOfOrderAndStale(t *testing.T) {
+	store := NewStore(nil, time.Minute)
+	appendSample := func(v float64, timestamp int64) int {
+		return store.Append(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{series(v, timestamp, "__name__", "requests_total")}})
+	}
+	gathered := func() []float64 {
+		families, _ := store.Gather()
+		result := []float64{}
+		for _, mf := range families {
+			for _, m := range mf.Metric {
+				result = append(result, m.GetUntyped().GetValue())
+			}
+		}
+		return result
+	}
+
+	appendSample(10, 2000)
+	// a retried older request must not move the counter backwards
+	if stored := appendSample(5, 1000); stored != 0 {
+		t.Errorf("stored %v series of an older sample, want 0", stored)
+	}
+	if got := gathered(); len(got) != 1 || got[0] != 10 {
+		t.Errorf("values = %v, want 10 of the newest sample", got)
+	}
+
+	appendSample(math.Float64frombits(value.StaleNaN), 3000)
+	if got := gathered(); len(got) != 0 {
+		t.Errorf("values = %v, want the series removed by the staleness marker", got)
+	}
+}
@@ -0,0 +1,241 @@
+package scrape
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/discovery"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// scrapeJob turns the groups found by the discoveries of a scrape config into targets
+type scrapeJob struct {
+	name        string
+	scheme      string
+	metricsPath string
+	relabel     []*relabel.Config
+	discoveries []discovery.Discoverer
+}
+
+var (
+	scrapeJobs     []*scrapeJob
+	scrapeJobsOnce sync.Once
+
+	// resolver of the dns_sd_configs, nil is the system resolver
+	resolver discovery.Resolver
+)
+
+// NewRelabelConfigs convert the relabel settings into Prometheus relabel configs, with the
+// Prometheus defaults and validation
+func NewRelabelConfigs(settings []setting.RelabelConfigS) ([]*relabel.Config, error) {
+	result := []*relabel.Config{}
+	for i, s := range settings {
+		out, err := yaml.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &relabel.Config{}
+		if err := yaml.UnmarshalStrict(out, cfg); err != nil {
+			return nil, fmt.Errorf("relabel_configs[%v] error: %v", i, err)
+		}
+		result = append(result, cfg)
+	}
+
+	return result, nil
+}
+
+func newScrapeJob(s setting.ScrapeConfigS) (*scrapeJob, error) {
+	if s.JobName == "" {
+		return nil, fmt.Errorf("scrape_configs has a job without job_name")
+	}
+
+	job := &scrapeJob{name: s.JobName, scheme: s.Scheme, metricsPath: s.MetricsPath}
+	if job.scheme == "" {
+		job.scheme = "http"
+	}
+	if job.scheme != "http" && job.scheme != "https" {
+		return nil, fmt.Errorf("scrape_configs %v scheme %q is not http or https", s.JobName, s.Scheme)
+	}
+	if job.metricsPath == "" {
+		job.metricsPath = "/metrics"
+	}
+
+	var err error
+	if job.relabel, err = NewRelabelConfigs(s.RelabelConfigs); err != nil {
+		return nil, fmt.Errorf("scrape_configs %v %v", s.JobName, err)
+	}
+	for _, sd := range s.FileSDConfigs {
+		d, err := discovery.NewFileDiscovery(sd)
+		if err != nil {
+			return nil, fmt.Errorf("scrape_configs %v %v", s.JobName, err)
+		}
+		job.discoveries = append(job.discoveries, d)
+	}
+	for _, sd := range s.DNSSDConfigs {
+		d, err := discovery.NewDNSDiscovery(sd, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("scrape_configs %v %v", s.JobName, err)
+		}
+		job.discoveries = append(job.discoveries, d)
+	}
+
+	return job, nil
+}
+
+// CheckScrapeConfigs report whether every scrape config is valid
+func CheckScrapeConfigs(settings []setting.ScrapeConfigS) error {
+	names := map[string]bool{}
+	for _, s := range settings {
+		if names[s.JobName] {
+			return fmt.Errorf("scrape_configs job_name %q is not unique", s.JobName)
+		}
+		names[s.JobName] = true
+
+		if _, err := newScrapeJob(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// targets return the targets of the current groups. Like Prometheus, a group target starts
+// with the group labels including the meta labels of its discovery and __address__, plus job,
+// __scheme__ and __metrics_path__ from the scrape config when the group does not set them. It
+// is relabeled, and dropped when relabeling drops it or leaves no __address__. Labels starting
+// with __ are removed afterwards, instance defaults to __address__. The scraped labels those
+// target labels conflict with are kept as exported_<name>, see targetGatherer
+func (j *scrapeJob) targets() []Target {
+	result := []Target{}
+	seen := map[uint64]bool{}
+
+	for _, d := range j.discoveries {
+		for _, group := range d.Groups() {
+			for _, address := range group.Targets {
+				lset := labels.FromMap(group.Labels)
+				builder := labels.NewBuilder(lset)
+				builder.Set(model.AddressLabel, address)
+				for name, value := range map[string]string{
+					model.JobLabel:         j.name,
+					model.SchemeLabel:      j.scheme,
+					model.MetricsPathLabel: j.metricsPath,
+				} {
+					if lset.Get(name) == "" {
+						builder.Set(name, value)
+					}
+				}
+
+				lset = relabel.Process(builder.Labels(), j.relabel...)
+				if lset == nil || lset.Get(model.AddressLabel) == "" {
+					continue
+				}
+				if seen[lset.Hash()] {
+					continue
+				}
+				seen[lset.Hash()] = true
+
+				u := url.URL{
+					Scheme: lset.Get(model.SchemeLabel),
+					Host:   lset.Get(model.AddressLabel),
+					Path:   lset.Get(model.MetricsPathLabel),
+				}
+
+				targetLabels := map[string]string{model.InstanceLabel: lset.Get(model.AddressLabel)}
+				for _, l := range lset {
+					if !strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+						targetLabels[l.Name] = l.Value
+					}
+				}
+
+				result = append(result, Target{
+					Name:     j.name,
+					URL:      u.String(),
+					Gatherer: &targetGatherer{gatherer: prom2json.NewTransFormGather(u.String()), labels: targetLabels},
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+// targetGatherer attach the target labels to the series of a discovered target. A scraped label
+// with the name of a target label is kept as exported_<name>, as Prometheus does without
+// honor_labels, instead of being overwritten
+type targetGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   map[string]string
+}
+
+func (g *targetGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			exportConflictingLabels(m, g.labels)
+			injectLabels(m, g.labels)
+		}
+	}
+
+	return families, err
+}
+
+// exportConflictingLabels rename the labels of metric that are also in labels to
+// exported_<name>, prefixed again while that name is taken by a scraped or a target label
+func exportConflictingLabels(metric *dto.Metric, labels map[string]string) {
+	taken := make(map[string]bool, len(metric.Label)+len(labels))
+	for _, l := range metric.Label {
+		taken[l.GetName()] = true
+	}
+	for name := range labels {
+		taken[name] = true
+	}
+
+	for _, l := range metric.Label {
+		if _, ok := labels[l.GetName()]; !ok || l.GetValue() == "" {
+			continue
+		}
+		name := model.ExportedLabelPrefix + l.GetName()
+		for taken[name] {
+			name = model.ExportedLabelPrefix + name
+		}
+		taken[name] = true
+		l.Name = proto.String(name)
+	}
+}
+
+// discoveredTargets return the targets of every scrape config. The discoveries are started
+// on the first call, which reads the files once before returning
+func discoveredTargets() []Target {
+	scrapeJobsOnce.Do(func() {
+		for _, s := range global.ScrapeConfigs {
+			job, err := newScrapeJob(s)
+			if err != nil {
+				global.LogObj.Errorf("%v", err)
+				continue
+			}
+			for _, d := range job.discoveries {
+				d.Refresh()
+				go d.Run(nil)
+			}
+			scrapeJobs = append(scrapeJobs, job)
+		}
+	})
+
+	result := []Target{}
+	for _, job := range scrapeJobs {
+		result = append(result, job.targets()...)
+	}
+
+	return result
+}
@@ -0,0 +1,136 @@
+package scrape
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrapeJobTargets(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	dir := t.TempDir()
+	content := `[
+  {"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"env": "prod", "__metrics_path__": "/node"}},
+  {"targets": ["10.0.0.3:9100"], "labels": {"env": "dev"}}
+]`
+	if err := ioutil.WriteFile(filepath.Join(dir, "targets.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := readScrapeConfigs(`
+scrape_configs:
+  - job_name: node
+    file_sd_configs:
+      - files: [` + filepath.Join(dir, "*.json") + `]
+        refresh_interval: 1m
+    relabel_configs:
+      - source_labels: [env]
+        regex: prod
+        action: keep
+      - source_labels: [__meta_filepath]
+        regex: '.*/(.*)\.json'
+        target_label: source
+      - source_labels: [__address__]
+        regex: '(.*):9100'
+        replacement: '${1}:19100'
+        target_label: __address__
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckScrapeConfigs(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := newScrapeJob(settings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.discoveries[0].Refresh()
+
+	targets := job.targets()
+	if len(targets) != 2 {
+		t.Fatalf("targets = %+v, want the 2 prod targets", targets)
+	}
+	if targets[0].URL != "http://10.0.0.1:19100/node" {
+		t.Errorf("url = %v", targets[0].URL)
+	}
+
+	labels := targets[0].Gatherer.(*targetGatherer).labels
+	want := map[string]string{"job": "node", "env": "prod", "source": "targets", "instance": "10.0.0.1:19100"}
+	if len(labels) != len(want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+	for k, v := range want {
+		if labels[k] != v {
+			t.Errorf("label %v = %q, want %q", k, labels[k], v)
+		}
+	}
+}
+
+func TestTargetGathererExportsConflicts(t *testing.T) {
+	g := &targetGatherer{
+		gatherer: static(gauge("up_jobs", 1, "job", "batch", "instance", "", "exported_instance", "x", "cpu", "0")),
+		labels:   map[string]string{"job": "node", "instance": "10.0.0.1:9100", "exported_job": "y"},
+	}
+
+	families, err := g.Gather()
+	if err != nil || len(families) != 1 {
+		t.Fatalf("families = %v, err = %v", families, err)
+	}
+
+	got := map[string]string{}
+	for _, l := range families[0].Metric[0].Label {
+		got[l.GetName()] = l.GetValue()
+	}
+	// the scraped job is kept as exported_job, which the target labels also set, so exported_exported_job;
+	// an empty scraped instance is no conflict and the target instance replaces it
+	want := map[string]string{
+		"job": "node", "instance": "10.0.0.1:9100", "exported_job": "y",
+		"exported_exported_job": "batch", "exported_instance": "x", "cpu": "0",
+	}
+	if len(got) != len(want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("label %v = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestCheckScrapeConfigsError(t *testing.T) {
+	for _, yaml := range []string{
+		"scrape_configs:\n  - file_sd_configs: [{files: [a.json]}]\n",
+		"scrape_configs:\n  - job_name: a\n  - job_name: a\n",
+		"scrape_configs:\n  - job_name: a\n    scheme: ftp\n",
+		"scrape_configs:\n  - job_name: a\n    relabel_configs: [{action: nope}]\n",
+		"scrape_configs:\n  - job_name: a\n    relabel_configs: [{action: replace, regex: '('}]\n",
+		"scrape_configs:\n  - job_name: a\n    file_sd_configs: [{files: [a.txt]}]\n",
+	} {
+		settings, err := readScrapeConfigs(yaml)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckScrapeConfigs(settings); err == nil {
+			t.Errorf("expected an error for %q", yaml)
+		}
+	}
+}
+
+func readScrapeConfigs(yaml string) ([]setting.ScrapeConfigS, error) {
+	s, err := setting.NewSettingFromReader(strings.NewReader(yaml), "yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	settings := []setting.ScrapeConfigS{}
+	err = s.ReadSection("scrape_configs", &settings)
+
+	return settings, err
+}
@@ -0,0 +1,354 @@
+package scrape
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/clickhouse_calc"
+	"github.com/exporterpush/internal/node_calc"
+	"github.com/exporterpush/internal/receiver"
+	"github.com/exporterpush/internal/sources"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is one configured scrape target
+type Target struct {
+	Name     string
+	URL      string
+	Gatherer prometheus.Gatherer
+}
+
+// BuiltinScheme prefixes the url of a target collected inside the agent, e.g. builtin://node
+const BuiltinScheme = "builtin://"
+
+// builtins are the collectors a builtin:// target can name
+var builtins = map[string]func() prometheus.Collector{
+	"node": func() prometheus.Collector { return node_calc.NewCollector() },
+	"host": func() prometheus.Collector {
+		// every sink gathers once per scrape interval, the ones within half of it share a sample
+		return node_calc.NewHostCollector(time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second / 2)
+	},
+	"clickhouse": func() prometheus.Collector {
+		return clickhouse_calc.NewCollector(global.GlobalSetting.Clickhouse)
+	},
+}
+
+var (
+	builtinRegistries = map[string]*prometheus.Registry{}
+	builtinMu         sync.Mutex
+
+	sourceGatherer prometheus.Gatherer
+	sourceOnce     sync.Once
+
+	receivedStore *receiver.Store
+	receivedOnce  sync.Once
+
+	pushedStore *receiver.GroupStore
+	pushedErr   error
+	pushedOnce  sync.Once
+)
+
+// Targets return every configured scrape target in config order, followed by the targets
+// currently found by the scrape_configs service discovery
+func Targets() []Target {
+	targets := []Target{}
+
+	for _, t := range []struct{ name, url string }{
+		{"node_exporter", global.GlobalSetting.ScrapeTargetTypes.NodeExporter},
+		{"clickhouse_exporter", global.GlobalSetting.ScrapeTargetTypes.ClickhouseExporter},
+	} {
+		if t.url == "" {
+			continue
+		}
+		targets = append(targets, Target{Name: t.name, URL: t.url, Gatherer: NewTargetGatherer(t.url)})
+	}
+
+	return append(targets, discoveredTargets()...)
+}
+
+// CheckURL report whether url can be scraped, an http url or a known builtin:// collector
+func CheckURL(url string) error {
+	if !strings.HasPrefix(url, BuiltinScheme) {
+		return nil
+	}
+
+	if _, ok := builtins[strings.TrimPrefix(url, BuiltinScheme)]; !ok {
+		return fmt.Errorf("unknown builtin scrape target %v", url)
+	}
+
+	return nil
+}
+
+// NewTargetGatherer return the gatherer of a scrape target url, a builtin:// url gathers the
+// collector of that name in process instead of scraping over http
+func NewTargetGatherer(url string) prometheus.Gatherer {
+	if !strings.HasPrefix(url, BuiltinScheme) {
+		return prom2json.NewTransFormGather(url)
+	}
+
+	name := strings.TrimPrefix(url, BuiltinScheme)
+	newCollector, ok := builtins[name]
+	if !ok {
+		return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, CheckURL(url)
+		})
+	}
+
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+
+	// the collectors keep the previous counters their usage and rate values are calculated
+	// from, so every gather of a builtin target goes through the same registry
+	registry, ok := builtinRegistries[name]
+	if !ok {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(newCollector())
+		builtinRegistries[name] = registry
+	}
+
+	return registry
+}
+
+// Sources return the gatherer of the sources configured under sources and of the series
+// received or pushed to the receiver, built once from global.SourcesSetting so stateful sources keep
+// their state between gathers
+func Sources() prometheus.Gatherer {
+	sourceOnce.Do(func() {
+		gatherer, err := sources.NewGatherer(global.SourcesSetting)
+		if err != nil {
+			gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return nil, err
+			})
+		}
+		sourceGatherer = prometheus.Gatherers{gatherer, Received(), Pushed()}
+	})
+
+	return sourceGatherer
+}
+
+// LoadPushed load the groups pushed through the Pushgateway API of the receiver once from the
+// persistence file of global.ReceiverSetting. The config check calls it so a file that can not
+// be loaded fails startup instead of being overwritten
+func LoadPushed() error {
+	pushedOnce.Do(func() {
+		file := ""
+		if global.ReceiverSetting != nil && global.ReceiverSetting.Pushgateway.IsUse {
+			file = global.ReceiverSetting.Pushgateway.PersistenceFile
+		}
+		pushedStore, pushedErr = receiver.NewGroupStore(file)
+		if pushedErr != nil {
+			// keep the groups in memory only, the file is left as it is
+			pushedStore, _ = receiver.NewGroupStore("")
+		}
+	})
+
+	return pushedErr
+}
+
+// Pushed return the groups pushed through the Pushgateway API of the receiver, see LoadPushed
+func Pushed() *receiver.GroupStore {
+	if err := LoadPushed(); err != nil {
+		global.LogObj.Errorf("receiver pushgateway %v", err)
+	}
+
+	return pushedStore
+}
+
+// Received return the store of the series pushed to the receiver, built once from
+// global.ReceiverSetting
+func Received() *receiver.Store {
+	receivedOnce.Do(func() {
+		s := global.ReceiverSetting
+		if s == nil {
+			s = &setting.ReceiverS{}
+		}
+		relabelConfigs, err := NewRelabelConfigs(s.RelabelConfigs)
+		if err != nil {
+			global.LogObj.Errorf("receiver %v", err)
+		}
+		receivedStore = receiver.NewStore(relabelConfigs, s.MaxAge)
+	})
+
+	return receivedStore
+}
+
+// SourceFamilies return the families of the configured sources in the shape of scraped
+// families, for the barad mapping
+func SourceFamilies() (map[string]*prom2json.Family, error) {
+	return familyMap(Sources())
+}
+
+// TargetFamilies return the families of the target url in the shape of scraped families,
+// for the barad mapping
+func TargetFamilies(url string) (map[string]*prom2json.Family, error) {
+	return familyMap(NewTargetGatherer(url))
+}
+
+func familyMap(g prometheus.Gatherer) (map[string]*prom2json.Family, error) {
+	families, err := g.Gather()
+
+	result := make(map[string]*prom2json.Family, len(families))
+	for _, mf := range families {
+		name, family := prom2json.NewFamily(mf)
+		result[name] = family
+	}
+
+	return result, err
+}
+
+// SinkMetricPointList gather every scrape target, the configured sources and the agent's own
+// metrics through NewGatherer, and convert the families to points with addLabel set, this is
+// what the sinks push. A failing target or source is logged and does not hold back the points
+// of the others
+func SinkMetricPointList(addLabel map[string]string) ([]global.MetricPoint, error) {
+	families, err := NewGatherer(nil).Gather()
+	if len(families) == 0 {
+		return nil, fmt.Errorf("gathered no metric family, error:%v", err)
+	}
+	if err != nil {
+		global.LogObj.Errorf("gather metrics partially failed: %v", err)
+	}
+
+	result := []global.MetricPoint{}
+	for _, mf := range families {
+		result = append(result, prom2json.NewMetricPointList(mf, addLabel)...)
+	}
+
+	return result, nil
+}
+
+// MetricPointList gather the target url and convert the families to points with addLabel set
+func MetricPointList(url string, addLabel map[string]string) ([]global.MetricPoint, error) {
+	families, err := NewTargetGatherer(url).Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []global.MetricPoint{}
+	for _, mf := range families {
+		result = append(result, prom2json.NewMetricPointList(mf, addLabel)...)
+	}
+
+	return result, nil
+}
+
+// NewGatherer return one gatherer merging every scrape target, the configured sources and the
+// agent's own collectors, with labels injected into every series. Every sink gathers through
+// it, so they all push the same data
+func NewGatherer(labels map[string]string) *MergedGatherer {
+	gatherers := []prometheus.Gatherer{}
+	for _, t := range Targets() {
+		gatherers = append(gatherers, t.Gatherer)
+	}
+	gatherers = append(gatherers, Sources(), prometheus.DefaultGatherer)
+
+	return &MergedGatherer{Gatherers: gatherers, Labels: labels}
+}
+
+// MergedGatherer gathers from all Gatherers and merges the families by name.
+// Families and series are resolved first come first served: a family whose type differs
+// from the one already gathered under the same name is dropped, and so is a series whose
+// label set, after the injection of Labels, is already present. A failing gatherer does
+// not hide the families of the others, its error is returned along with them.
+type MergedGatherer struct {
+	Gatherers []prometheus.Gatherer
+	Labels    map[string]string
+}
+
+func (m *MergedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	errs := prometheus.MultiError{}
+	familyByName := map[string]*dto.MetricFamily{}
+	seriesSeen := map[string]bool{}
+
+	for _, g := range m.Gatherers {
+		families, err := g.Gather()
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, mf := range families {
+			existing, ok := familyByName[mf.GetName()]
+			if ok && existing.GetType() != mf.GetType() {
+				errs = append(errs, fmt.Errorf("family %v gathered as %v and %v, keeping %v",
+					mf.GetName(), existing.GetType(), mf.GetType(), existing.GetType()))
+				continue
+			}
+			if !ok {
+				existing = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				familyByName[mf.GetName()] = existing
+			}
+
+			for _, metric := range mf.Metric {
+				injectLabels(metric, m.Labels)
+
+				signature := mf.GetName() + signatureOf(metric.Label)
+				if seriesSeen[signature] {
+					continue
+				}
+				seriesSeen[signature] = true
+				existing.Metric = append(existing.Metric, metric)
+			}
+		}
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(familyByName))
+	for _, mf := range familyByName {
+		if len(mf.Metric) > 0 {
+			result = append(result, mf)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+
+	return result, errs.MaybeUnwrap()
+}
+
+// injectLabels set labels on the metric, overriding the scraped value like the
+// remote write conversion does, and keeps the label pairs sorted by name
+func injectLabels(metric *dto.Metric, labels map[string]string) {
+	for name, value := range labels {
+		found := false
+		for _, lp := range metric.Label {
+			if lp.GetName() == name {
+				lp.Value = proto.String(value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+	}
+
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+}
+
+func signatureOf(labelPairs []*dto.LabelPair) string {
+	b := strings.Builder{}
+	for _, lp := range labelPairs {
+		b.WriteString("\xff")
+		b.WriteString(lp.GetName())
+		b.WriteString("\xff")
+		b.WriteString(lp.GetValue())
+	}
+
+	return b.String()
+}
+
+// Snapshot is a gatherer returning families gathered earlier, so every destination of a
+// sink receives exactly the same data
+type Snapshot []*dto.MetricFamily
+
+func (s Snapshot) Gather() ([]*dto.MetricFamily, error) {
+	return s, nil
+}
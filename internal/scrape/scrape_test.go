@@ -0,0 +1,106 @@
+package scrape
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func gauge(name string, value float64, labels ...string) *dto.MetricFamily {
+	metric := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{metric}}
+}
+
+func static(families ...*dto.MetricFamily) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	})
+}
+
+func TestMergedGatherer(t *testing.T) {
+	counter := gauge("go_goroutines", 3)
+	counter.Type = dto.MetricType_COUNTER.Enum()
+
+	g := &MergedGatherer{
+		Gatherers: []prometheus.Gatherer{
+			static(gauge("go_goroutines", 1), gauge("node_load1", 0.5)),
+			static(gauge("go_goroutines", 2), gauge("node_load1", 0.7, "cpu", "0")),
+			static(counter),
+			prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return nil, fmt.Errorf("target down")
+			}),
+		},
+		Labels: map[string]string{"cluster_name": "test"},
+	}
+
+	families, err := g.Gather()
+	if err == nil {
+		t.Error("expected the failing gatherer and the type conflict to be reported")
+	}
+
+	if len(families) != 2 || families[0].GetName() != "go_goroutines" || families[1].GetName() != "node_load1" {
+		t.Fatalf("unexpected families: %v", families)
+	}
+
+	// the duplicate series of the second target is dropped, the first one wins
+	if len(families[0].Metric) != 1 || families[0].Metric[0].GetGauge().GetValue() != 1 {
+		t.Errorf("duplicate series not resolved: %v", families[0])
+	}
+	if families[0].GetType() != dto.MetricType_GAUGE {
+		t.Errorf("conflicting type replaced the first family: %v", families[0].GetType())
+	}
+
+	// series with distinct labels are merged, all carry the injected label
+	if len(families[1].Metric) != 2 {
+		t.Fatalf("series with distinct labels not merged: %v", families[1])
+	}
+	for _, metric := range families[1].Metric {
+		found := false
+		for _, lp := range metric.Label {
+			if lp.GetName() == "cluster_name" && lp.GetValue() == "test" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("label not injected: %v", metric)
+		}
+	}
+}
+
+func TestBuiltinTarget(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	global.GlobalSetting = &setting.GlobalS{}
+
+	points, err := MetricPointList("builtin://node", map[string]string{"cluster_name": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, p := range points {
+		if p.Metric == "node_memory_MemTotal_bytes" {
+			found = p.Value > 0 && p.LabelMap["cluster_name"] == "test"
+		}
+	}
+	if !found {
+		t.Error("builtin://node lacks node_memory_MemTotal_bytes with the added label")
+	}
+
+	if err := CheckURL("builtin://nope"); err == nil {
+		t.Error("expected an error for an unknown builtin target")
+	}
+	if _, err := NewTargetGatherer("builtin://nope").Gather(); err == nil {
+		t.Error("expected the unknown builtin target to fail on gather")
+	}
+}
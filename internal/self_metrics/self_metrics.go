@@ -0,0 +1,29 @@
+package self_metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// PushCycleDuration is the time every push cycle of a sink takes, from collecting the metrics
+// to the end of the delivery. It is registered to the default registry, which every sink
+// gathers along with the scrape targets
+var PushCycleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "exporterpush_push_cycle_duration_seconds",
+	Help:    "Duration of one collect and push cycle of a sink.",
+	Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"sink", "result"})
+
+func init() {
+	prometheus.MustRegister(PushCycleDuration)
+}
+
+// ObserveCycle record a push cycle of sink started at begin, err is its outcome
+func ObserveCycle(sink string, begin time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	PushCycleDuration.WithLabelValues(sink, result).Observe(time.Since(begin).Seconds())
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/receiver"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/pkg/util"
+	"net/http"
+	"time"
+)
+
+const (
+	receiverShutdownTimeout = 5 * time.Second
+
+	defaultPersistenceInterval = 5 * time.Minute
+)
+
+var (
+	receiverServer *http.Server
+	persistStop    chan struct{}
+)
+
+// NewReceiverMux return the handlers of the endpoints the agent accepts metrics on
+func NewReceiverMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(receiver.WritePath, receiver.NewWriteHandler(scrape.Received()))
+	if global.ReceiverSetting != nil && global.ReceiverSetting.Pushgateway.IsUse {
+		mux.Handle(receiver.PushPath, receiver.NewPushHandler(scrape.Pushed()))
+	}
+
+	return mux
+}
+
+// runReceiver listen on the receiver listen_address until shutdown, when one is set
+func runReceiver() {
+	if global.ReceiverSetting == nil || global.ReceiverSetting.ListenAddress == "" {
+		return
+	}
+
+	addr := global.ReceiverSetting.ListenAddress
+	receiverServer = &http.Server{Addr: addr, Handler: NewReceiverMux()}
+	go func(srv *http.Server) {
+		defer util.CatchException(func(e interface{}) {
+			global.LogObj.Panic(e)
+		})
+
+		global.LogObj.Infof("receiver listen on %v", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			global.LogObj.Errorf("receiver listen on %v error: %v", addr, err)
+		}
+	}(receiverServer)
+
+	if global.ReceiverSetting.Pushgateway.IsUse && global.ReceiverSetting.Pushgateway.PersistenceFile != "" {
+		persistStop = make(chan struct{})
+		go persistPushed(persistStop)
+	}
+}
+
+// persistPushed save the pushed groups every persistence interval until stop is closed
+func persistPushed(stop <-chan struct{}) {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	interval := global.ReceiverSetting.Pushgateway.PersistenceInterval
+	if interval <= 0 {
+		interval = defaultPersistenceInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := scrape.Pushed().Save(); err != nil {
+				global.LogObj.Errorf("save pushed groups error: %v", err)
+			}
+		}
+	}
+}
+
+// shutdownReceiver stop accepting metrics, letting the requests in flight finish, and save
+// the pushed groups one last time
+func shutdownReceiver() {
+	if receiverServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), receiverShutdownTimeout)
+	defer cancel()
+	if err := receiverServer.Shutdown(ctx); err != nil {
+		global.LogObj.Errorf("shutdown receiver error: %v", err)
+	}
+
+	if persistStop != nil {
+		close(persistStop)
+		if err := scrape.Pushed().Save(); err != nil {
+			global.LogObj.Errorf("save pushed groups error: %v", err)
+		}
+	}
+}
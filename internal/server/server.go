@@ -1,24 +1,43 @@
 package server
 
 import (
+	"fmt"
 	"github.com/exporterpush/global"
 	"github.com/exporterpush/internal/barad_ck_push"
+	"github.com/exporterpush/internal/file_push"
+	"github.com/exporterpush/internal/http_json_push"
 	"github.com/exporterpush/internal/prometheus_push"
 	"github.com/exporterpush/internal/pushgateway_push"
+	"github.com/exporterpush/internal/stdout_push"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
-var services []func()
+// service is a push sink, run loops forever on the scrape interval, once pushes a single
+// time and shutdown, when set, cleans up after the sink on graceful shutdown
+type service struct {
+	name     string
+	run      func()
+	once     func() error
+	shutdown func() error
+}
+
+var services []service
 
-func registry(f func(), name string) {
-	services = append(services, f)
+func registry(f func(), once func() error, shutdown func() error, name string) {
+	services = append(services, service{name: name, run: f, once: once, shutdown: shutdown})
 	global.LogObj.Infof("registry service handler:%v", name)
 }
 
 func Run() {
 
+	runReceiver()
+
 	if services != nil {
-		for _, f := range services {
-			go f()
+		for _, s := range services {
+			go s.run()
 		}
 	} else {
 		global.LogObj.Warnf("no service to run，services Handler is nil")
@@ -26,16 +45,99 @@ func Run() {
 
 }
 
+// Shutdown stop the receiver and run the shutdown hook of every registered sink
+func Shutdown() {
+	shutdownReceiver()
+
+	for _, s := range services {
+		if s.shutdown == nil {
+			continue
+		}
+
+		if err := s.shutdown(); err != nil {
+			global.LogObj.Errorf("shutdown service %v error:%v", s.name, err)
+		}
+	}
+}
+
+// RunOnce push one time to every registered sink, prints a per-sink summary to
+// stdout and reports whether all of them succeeded
+func RunOnce() bool {
+	if services == nil {
+		global.LogObj.Warnf("no service to run，services Handler is nil")
+		fmt.Println("no sink is enabled")
+		return false
+	}
+
+	type result struct {
+		err      error
+		duration time.Duration
+	}
+	results := make([]result, len(services))
+
+	var wg sync.WaitGroup
+	for i, s := range services {
+		wg.Add(1)
+		go func(i int, s service) {
+			defer wg.Done()
+			defer func() {
+				if e := recover(); e != nil {
+					results[i].err = fmt.Errorf("panic: %v", e)
+				}
+			}()
+
+			start := time.Now()
+			results[i].err = s.once()
+			results[i].duration = time.Since(start)
+		}(i, s)
+	}
+	wg.Wait()
+
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SINK\tSTATUS\tDURATION\tERROR")
+	for i, s := range services {
+		status := "ok"
+		errInfo := "-"
+		if results[i].err != nil {
+			ok = false
+			status = "failed"
+			errInfo = results[i].err.Error()
+			global.LogObj.Errorf("once push %v error:%v", s.name, results[i].err)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", s.name, status, results[i].duration.Round(time.Millisecond), errInfo)
+	}
+	w.Flush()
+
+	return ok
+}
+
 func init() {
 	if global.BaradSetting.IsUse {
-		registry(barad_ck_push.BaradCKPush, "BaradClickhousePush")
+		registry(barad_ck_push.BaradCKPush, barad_ck_push.BaradCKPushOnce, nil, "BaradClickhousePush")
 	}
 
 	if global.PushgatewaySetting.IsUse {
-		registry(pushgateway_push.PushGatewayPush, "PushGatewayPush")
+		registry(pushgateway_push.PushGatewayPush, pushgateway_push.PushGatewayPushOnce, pushgateway_push.PushGatewayDelete, "PushGatewayPush")
 	}
 
 	if global.PrometheusSetting.IsUse {
-		registry(prometheus_push.PrometheusPush, "PrometheusPush")
+		registry(prometheus_push.PrometheusPush, prometheus_push.PushOnce, nil, "PrometheusPush")
+	}
+
+	if global.FileSetting.IsUse {
+		registry(file_push.FilePush, file_push.FilePushOnce, nil, "FilePush")
+	}
+
+	if global.StdoutSetting.IsUse {
+		registry(stdout_push.StdoutPush, stdout_push.StdoutPushOnce, nil, "StdoutPush")
+	}
+
+	for i := range global.HttpJsonSettings {
+		s := &global.HttpJsonSettings[i]
+		if s.IsUse {
+			run, once := http_json_push.HttpJsonPush(s)
+			registry(run, once, nil, "HttpJsonPush/"+s.Name)
+		}
 	}
 }
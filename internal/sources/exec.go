@@ -0,0 +1,281 @@
+package sources
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	execExitCodeName = "exporterpush_exec_exit_code"
+	execDurationName = "exporterpush_exec_duration_seconds"
+
+	defaultExecTimeout = 10
+
+	// execWaitDelay is how long the output is read after the command exited, a process it left
+	// behind may keep the output open
+	execWaitDelay = time.Second
+)
+
+// ExecGatherer runs a command that prints Prometheus text exposition to stdout and returns
+// the parsed families with the exit code and duration of the run. The output is parsed
+// whatever the exit code, except after a timeout, when the process group of the command is
+// killed. The command runs on its own every interval, starting with the first gather, and
+// gathers return the result of the last run, so a slow command never holds up the sinks
+type ExecGatherer struct {
+	name     string
+	command  []string
+	env      []string
+	dir      string
+	timeout  time.Duration
+	interval time.Duration
+
+	once     sync.Once
+	mu       sync.Mutex
+	families []*dto.MetricFamily
+}
+
+// NewExecGatherer return the ExecGatherer of s running every interval, an interval of 0 runs
+// the command on the first gather only
+func NewExecGatherer(s setting.ExecS, interval time.Duration) (*ExecGatherer, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("sources.exec has an entry without name")
+	}
+	if len(s.Command) == 0 {
+		return nil, fmt.Errorf("sources.exec %q has no command", s.Name)
+	}
+	for _, kv := range s.Env {
+		if !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("sources.exec %q env %q is not KEY=value", s.Name, kv)
+		}
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+
+	return &ExecGatherer{
+		name:     s.Name,
+		command:  s.Command,
+		env:      s.Env,
+		dir:      s.Dir,
+		timeout:  time.Duration(timeout) * time.Second,
+		interval: interval,
+	}, nil
+}
+
+// Gather return a copy of the families of the last run, the first gather waits for the first
+// run and starts the loop
+func (g *ExecGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.once.Do(func() {
+		g.refresh()
+		if g.interval > 0 {
+			go g.Run(nil)
+		}
+	})
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// the gathered families get the labels of the sinks injected, the cached ones must not
+	result := make([]*dto.MetricFamily, 0, len(g.families))
+	for _, mf := range g.families {
+		result = append(result, proto.Clone(mf).(*dto.MetricFamily))
+	}
+
+	return result, nil
+}
+
+// Run the command every interval until stop is closed
+func (g *ExecGatherer) Run(stop <-chan struct{}) {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			g.refresh()
+		}
+	}
+}
+
+func (g *ExecGatherer) refresh() {
+	families := g.run()
+
+	g.mu.Lock()
+	g.families = families
+	g.mu.Unlock()
+}
+
+// run the command once and return its families, failures are logged and reported by the
+// exit code, the output of a failed run is still used when it parses
+func (g *ExecGatherer) run() []*dto.MetricFamily {
+	cmd := exec.Command(g.command[0], g.command[1:]...)
+	cmd.Dir = g.dir
+	cmd.Env = append(os.Environ(), g.env...)
+	// a process group of its own, so a timeout kills the children of a script too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	begin := time.Now()
+	exitCode := -1.0
+	families := []*dto.MetricFamily{}
+
+	stdoutPipe, err := newOutputPipe()
+	if err != nil {
+		global.LogObj.Errorf("exec source %v stdout error: %v", g.name, err)
+		return append(families, g.runFamilies(exitCode, time.Since(begin))...)
+	}
+	stderrPipe, err := newOutputPipe()
+	if err != nil {
+		stdoutPipe.close()
+		global.LogObj.Errorf("exec source %v stderr error: %v", g.name, err)
+		return append(families, g.runFamilies(exitCode, time.Since(begin))...)
+	}
+	cmd.Stdout, cmd.Stderr = stdoutPipe.w, stderrPipe.w
+
+	err = cmd.Start()
+	// the command holds the write ends now, ours must be closed for the output to end
+	stdoutPipe.w.Close()
+	stderrPipe.w.Close()
+	if err != nil {
+		stdoutPipe.close()
+		stderrPipe.close()
+		global.LogObj.Errorf("exec source %v start error: %v", g.name, err)
+		return append(families, g.runFamilies(exitCode, time.Since(begin))...)
+	}
+
+	timedOut := false
+	var timedOutMu sync.Mutex
+	timer := time.AfterFunc(g.timeout, func() {
+		timedOutMu.Lock()
+		timedOut = true
+		timedOutMu.Unlock()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	duration := time.Since(begin)
+	stdout, stdoutOpen := stdoutPipe.wait(execWaitDelay)
+	stderr, _ := stderrPipe.wait(execWaitDelay)
+	if stdoutOpen {
+		global.LogObj.Warnf("exec source %v left a process holding its output open, output read until %v after the exit", g.name, execWaitDelay)
+	}
+
+	timedOutMu.Lock()
+	killed := timedOut
+	timedOutMu.Unlock()
+
+	switch {
+	case killed:
+		global.LogObj.Errorf("exec source %v killed after the timeout of %v", g.name, g.timeout)
+		return append(families, g.runFamilies(exitCode, duration)...)
+	case err != nil:
+		global.LogObj.Errorf("exec source %v error: %v: %v", g.name, err, firstLine(stderr.String()))
+	}
+	exitCode = float64(cmd.ProcessState.ExitCode())
+
+	mfChan := make(chan *dto.MetricFamily, 1024)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- prom2json.ParseReader(stdout, mfChan)
+	}()
+	for mf := range mfChan {
+		families = append(families, mf)
+	}
+	if err := <-errChan; err != nil {
+		global.LogObj.Errorf("exec source %v output error: %v", g.name, err)
+		families = families[:0]
+	}
+
+	return append(families, g.runFamilies(exitCode, duration)...)
+}
+
+func (g *ExecGatherer) runFamilies(exitCode float64, duration time.Duration) []*dto.MetricFamily {
+	label := []*dto.LabelPair{{Name: proto.String("name"), Value: proto.String(g.name)}}
+
+	return []*dto.MetricFamily{
+		{
+			Name:   proto.String(execExitCodeName),
+			Help:   proto.String("Exit code of the last run of the exec source, -1 when it did not start or was killed."),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: label, Gauge: &dto.Gauge{Value: proto.Float64(exitCode)}}},
+		},
+		{
+			Name:   proto.String(execDurationName),
+			Help:   proto.String("Duration of the last run of the exec source in seconds."),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: label, Gauge: &dto.Gauge{Value: proto.Float64(duration.Seconds())}}},
+		},
+	}
+}
+
+// outputPipe is a pipe a command writes to directly, unlike a buffer set as cmd.Stdout, so
+// Wait returns when the command exits even if a process it left behind keeps the pipe open
+type outputPipe struct {
+	r, w *os.File
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+func newOutputPipe() (*outputPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &outputPipe{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		io.Copy(&p.buf, r)
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+// wait return what was written once every writer closed the pipe, or after delay, which it
+// reports as still open
+func (p *outputPipe) wait(delay time.Duration) (*bytes.Buffer, bool) {
+	open := false
+	select {
+	case <-p.done:
+	case <-time.After(delay):
+		open = true
+	}
+	p.close()
+
+	return &p.buf, open
+}
+
+func (p *outputPipe) close() {
+	p.w.Close()
+	p.r.Close()
+	<-p.done
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+
+	return s
+}
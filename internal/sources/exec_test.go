@@ -0,0 +1,155 @@
+package sources
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func gatherExec(t *testing.T, s setting.ExecS, maxAge time.Duration) map[string]float64 {
+	g, err := NewExecGatherer(s, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return execValues(t, g)
+}
+
+// execValues gather g into family name to the value of its first series
+func execValues(t *testing.T, g *ExecGatherer) map[string]float64 {
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]float64{}
+	for _, mf := range families {
+		m := mf.Metric[0]
+		switch {
+		case m.Gauge != nil:
+			result[mf.GetName()] = m.GetGauge().GetValue()
+		case m.Counter != nil:
+			result[mf.GetName()] = m.GetCounter().GetValue()
+		default:
+			result[mf.GetName()] = m.GetUntyped().GetValue()
+		}
+	}
+
+	return result
+}
+
+func TestExecGatherer(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	dir := t.TempDir()
+
+	values := gatherExec(t, setting.ExecS{
+		Name:    "check",
+		Command: []string{"/bin/sh", "-c", `echo "check_value{dir=\"$(pwd)\"} $CHECK_VALUE"; exit 3`},
+		Env:     []string{"CHECK_VALUE=42"},
+		Dir:     dir,
+	}, 0)
+	if values["check_value"] != 42 {
+		t.Errorf("check_value = %v, want 42 from the env", values["check_value"])
+	}
+	if values[execExitCodeName] != 3 {
+		t.Errorf("exit code = %v, want 3", values[execExitCodeName])
+	}
+	if _, ok := values[execDurationName]; !ok {
+		t.Error("no duration metric")
+	}
+
+	values = gatherExec(t, setting.ExecS{Name: "bad", Command: []string{"/bin/echo", "not exposition {"}}, 0)
+	if len(values) != 2 || values[execExitCodeName] != 0 {
+		t.Errorf("values = %v, want only the exit code 0 and duration for unparsable output", values)
+	}
+
+	values = gatherExec(t, setting.ExecS{Name: "missing", Command: []string{"/no/such/program"}}, 0)
+	if values[execExitCodeName] != -1 {
+		t.Errorf("exit code = %v, want -1 for a program that does not start", values[execExitCodeName])
+	}
+}
+
+func TestExecGathererTimeout(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	begin := time.Now()
+	// the child keeps stdout open, so only killing the process group ends the run
+	values := gatherExec(t, setting.ExecS{
+		Name:    "hang",
+		Command: []string{"/bin/sh", "-c", "echo hang_value 1; sleep 30 & wait"},
+		Timeout: 1,
+	}, 0)
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("run took %v, want it killed after 1s", elapsed)
+	}
+	if values[execExitCodeName] != -1 {
+		t.Errorf("exit code = %v, want -1 for a killed run", values[execExitCodeName])
+	}
+	if _, ok := values["hang_value"]; ok {
+		t.Error("used the output of a killed run")
+	}
+}
+
+func TestExecGathererLeftBehind(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	begin := time.Now()
+	// the child escapes the process group and keeps stdout open after the script exited
+	values := gatherExec(t, setting.ExecS{
+		Name:    "daemon",
+		Command: []string{"/bin/sh", "-c", "echo daemon_value 1; setsid sleep 30 &"},
+		Timeout: 5,
+	}, 0)
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("run took %v, want the output given up after %v", elapsed, execWaitDelay)
+	}
+	if values["daemon_value"] != 1 || values[execExitCodeName] != 0 {
+		t.Errorf("values = %v, want daemon_value 1 and exit code 0", values)
+	}
+}
+
+func TestExecGathererInterval(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	counter := t.TempDir() + "/runs"
+
+	g, err := NewExecGatherer(setting.ExecS{
+		Name:    "count",
+		Command: []string{"/bin/sh", "-c", "echo x >> " + counter + "; echo runs $(wc -l < " + counter + "); sleep 0.2"},
+	}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := execValues(t, g)["runs"]; runs != 1 {
+		t.Fatalf("runs = %v, want the first gather to wait for the first run", runs)
+	}
+
+	// the gathers return the last result at once while the next run is still going
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		execValues(t, g)
+	}
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("gathers took %v, want them not to wait for a run", elapsed)
+	}
+
+	time.Sleep(time.Second)
+	if runs := execValues(t, g)["runs"]; runs < 2 {
+		t.Errorf("runs = %v, want the command run again every interval", runs)
+	}
+}
+
+func TestNewExecGathererError(t *testing.T) {
+	for _, s := range []setting.ExecS{
+		{Command: []string{"/bin/true"}},
+		{Name: "empty"},
+		{Name: "env", Command: []string{"/bin/true"}, Env: []string{"NOVALUE"}},
+	} {
+		if _, err := NewExecGatherer(s, 0); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package sources
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/exporterpush/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeTimeout = 5
+
+	// only the start of a large body is matched against body_regex
+	maxProbeBodyBytes = 1 << 20
+)
+
+var (
+	probeLabels = []string{"name"}
+
+	probeSuccessDesc = prometheus.NewDesc("probe_success",
+		"Whether the probe succeeded.", probeLabels, nil)
+	probeDurationDesc = prometheus.NewDesc("probe_duration_seconds",
+		"Duration of the probe in seconds.", probeLabels, nil)
+	probeStatusCodeDesc = prometheus.NewDesc("probe_http_status_code",
+		"Response HTTP status code of the http probe, 0 when there was no response.", probeLabels, nil)
+	probeSSLExpiryDesc = prometheus.NewDesc("probe_ssl_earliest_cert_expiry",
+		"Earliest expiry of the certificates the server presented since unix epoch in seconds.", probeLabels, nil)
+)
+
+// ProbeCollector checks targets from the agent like the blackbox_exporter: the http module
+// requests a URL and checks the status code, the body and the TLS certificates, the tcp module
+// connects to an address. The probes run concurrently, collects within maxAge of the last
+// run reuse its results, so the sinks gathering on the same interval share one run
+type ProbeCollector struct {
+	probes []probe
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	lastRun time.Time
+	results []probeResult
+}
+
+type probe struct {
+	name        string
+	module      string
+	target      string
+	timeout     time.Duration
+	validStatus map[int]bool
+	bodyRe      *regexp.Regexp
+	client      *http.Client
+}
+
+// probeResult is the outcome of one probe, expiry is zero without TLS
+type probeResult struct {
+	success    bool
+	duration   time.Duration
+	statusCode int
+	expiry     time.Time
+}
+
+// NewProbeCollector return a ProbeCollector of the probes, running them at most once per maxAge
+func NewProbeCollector(settings []setting.ProbeS, maxAge time.Duration) (*ProbeCollector, error) {
+	c := &ProbeCollector{maxAge: maxAge}
+	names := map[string]bool{}
+
+	for i, s := range settings {
+		if s.Name == "" {
+			return nil, fmt.Errorf("sources.probe[%v] has no name", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("sources.probe name %q is not unique", s.Name)
+		}
+		names[s.Name] = true
+
+		timeout := s.Timeout
+		if timeout <= 0 {
+			timeout = defaultProbeTimeout
+		}
+		p := probe{name: s.Name, module: s.Module, target: s.Target, timeout: time.Duration(timeout) * time.Second}
+
+		switch s.Module {
+		case "http":
+			u, err := url.Parse(s.Target)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("sources.probe %q target %q is not a http or https url", s.Name, s.Target)
+			}
+			if len(s.ValidStatusCodes) > 0 {
+				p.validStatus = map[int]bool{}
+				for _, code := range s.ValidStatusCodes {
+					p.validStatus[code] = true
+				}
+			}
+			if s.BodyRegex != "" {
+				if p.bodyRe, err = regexp.Compile(s.BodyRegex); err != nil {
+					return nil, fmt.Errorf("sources.probe %q body_regex error: %v", s.Name, err)
+				}
+			}
+			p.client = &http.Client{
+				Timeout: p.timeout,
+				// a new connection every probe, so the probe also checks connecting and the handshake
+				Transport: &http.Transport{
+					Proxy:             http.ProxyFromEnvironment,
+					DisableKeepAlives: true,
+					TLSClientConfig:   &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify},
+				},
+			}
+		case "tcp":
+			if _, _, err := net.SplitHostPort(s.Target); err != nil {
+				return nil, fmt.Errorf("sources.probe %q target %q is not host:port", s.Name, s.Target)
+			}
+		default:
+			return nil, fmt.Errorf("sources.probe %q module %q is not http or tcp", s.Name, s.Module)
+		}
+
+		c.probes = append(c.probes, p)
+	}
+
+	return c, nil
+}
+
+func (c *ProbeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{probeSuccessDesc, probeDurationDesc, probeStatusCodeDesc, probeSSLExpiryDesc} {
+		ch <- desc
+	}
+}
+
+func (c *ProbeCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, r := range c.run() {
+		p := c.probes[i]
+		success := 0.0
+		if r.success {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, success, p.name)
+		ch <- prometheus.MustNewConstMetric(probeDurationDesc, prometheus.GaugeValue, r.duration.Seconds(), p.name)
+		if p.module == "http" {
+			ch <- prometheus.MustNewConstMetric(probeStatusCodeDesc, prometheus.GaugeValue, float64(r.statusCode), p.name)
+		}
+		if !r.expiry.IsZero() {
+			ch <- prometheus.MustNewConstMetric(probeSSLExpiryDesc, prometheus.GaugeValue, float64(r.expiry.Unix()), p.name)
+		}
+	}
+}
+
+// run every probe concurrently unless the results of the last run are younger than maxAge,
+// the results are in the order of the probes
+func (c *ProbeCollector) run() []probeResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil && time.Since(c.lastRun) < c.maxAge {
+		return c.results
+	}
+
+	results := make([]probeResult, len(c.probes))
+	var wg sync.WaitGroup
+	for i, p := range c.probes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			defer util.CatchException(func(e interface{}) {
+				global.LogObj.Panic(e)
+			})
+
+			results[i] = p.run()
+		}(i, p)
+	}
+	wg.Wait()
+	c.results, c.lastRun = results, time.Now()
+
+	return results
+}
+
+// run the probe once, failures are logged
+func (p probe) run() probeResult {
+	begin := time.Now()
+	var (
+		r   probeResult
+		err error
+	)
+	if p.module == "tcp" {
+		err = p.tcp()
+	} else {
+		err = p.http(&r)
+	}
+	r.duration = time.Since(begin)
+	r.success = err == nil
+	if err != nil {
+		global.LogObj.Errorf("probe source %v %v error: %v", p.name, p.target, err)
+	}
+
+	return r
+}
+
+func (p probe) tcp() error {
+	conn, err := net.DialTimeout("tcp", p.target, p.timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// http request the target, a status code outside the valid ones (2xx by default) or a body
+// not matching body_regex fails the probe
+func (p probe) http(r *probeResult) error {
+	resp, err := p.client.Get(p.target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	r.statusCode = resp.StatusCode
+	if resp.TLS != nil {
+		for _, cert := range resp.TLS.PeerCertificates {
+			if r.expiry.IsZero() || cert.NotAfter.Before(r.expiry) {
+				r.expiry = cert.NotAfter
+			}
+		}
+	}
+
+	if p.validStatus != nil {
+		if !p.validStatus[resp.StatusCode] {
+			return fmt.Errorf("status code %v is not one of the valid status codes", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %v is not 2xx", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBodyBytes))
+	if err != nil {
+		return err
+	}
+	if p.bodyRe != nil && !p.bodyRe.Match(body) {
+		return fmt.Errorf("body does not match %v", p.bodyRe)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package sources
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// probeValues gather the probes into name/family to value
+func probeValues(t *testing.T, settings []setting.ProbeS) map[string]float64 {
+	c, err := NewProbeCollector(settings, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			result[m.Label[0].GetValue()+"/"+mf.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+
+	return result
+}
+
+func TestProbeHTTP(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, "Ok.\n")
+	}))
+	defer server.Close()
+
+	values := probeValues(t, []setting.ProbeS{
+		{Name: "ok", Module: "http", Target: server.URL + "/ping", BodyRegex: "^Ok"},
+		{Name: "body", Module: "http", Target: server.URL + "/ping", BodyRegex: "ready"},
+		{Name: "error", Module: "http", Target: server.URL + "/error"},
+		{Name: "expected_error", Module: "http", Target: server.URL + "/error", ValidStatusCodes: []int{500}},
+	})
+
+	for name, want := range map[string]float64{"ok": 1, "body": 0, "error": 0, "expected_error": 1} {
+		if values[name+"/probe_success"] != want {
+			t.Errorf("%v probe_success = %v, want %v", name, values[name+"/probe_success"], want)
+		}
+	}
+	if values["error/probe_http_status_code"] != 500 {
+		t.Errorf("status code = %v, want 500", values["error/probe_http_status_code"])
+	}
+	if _, ok := values["ok/probe_duration_seconds"]; !ok {
+		t.Error("probe_duration_seconds is missing")
+	}
+	if _, ok := values["ok/probe_ssl_earliest_cert_expiry"]; ok {
+		t.Error("probe_ssl_earliest_cert_expiry of a plain http probe")
+	}
+}
+
+func TestProbeHTTPS(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	values := probeValues(t, []setting.ProbeS{
+		{Name: "insecure", Module: "http", Target: server.URL, InsecureSkipVerify: true},
+		{Name: "verified", Module: "http", Target: server.URL},
+	})
+
+	if values["insecure/probe_success"] != 1 {
+		t.Errorf("insecure probe_success = %v, want 1", values["insecure/probe_success"])
+	}
+	want := float64(server.Certificate().NotAfter.Unix())
+	if values["insecure/probe_ssl_earliest_cert_expiry"] != want {
+		t.Errorf("expiry = %v, want %v", values["insecure/probe_ssl_earliest_cert_expiry"], want)
+	}
+	// the test certificate is not trusted
+	if values["verified/probe_success"] != 0 {
+		t.Errorf("verified probe_success = %v, want 0", values["verified/probe_success"])
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	values := probeValues(t, []setting.ProbeS{
+		{Name: "open", Module: "tcp", Target: listener.Addr().String()},
+		{Name: "closed", Module: "tcp", Target: closedAddr, Timeout: 1},
+	})
+
+	if values["open/probe_success"] != 1 || values["closed/probe_success"] != 0 {
+		t.Errorf("values = %v, want the open port up and the closed one down", values)
+	}
+	if _, ok := values["open/probe_http_status_code"]; ok {
+		t.Error("probe_http_status_code of a tcp probe")
+	}
+}
+
+func TestProbeReuse(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	c, err := NewProbeCollector([]setting.ProbeS{{Name: "ok", Module: "http", Target: server.URL}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every sink gathers its own registry, they share the probe run
+	for i := 0; i < 3; i++ {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(c)
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("target probed %v times, want once while the result is younger than maxAge", n)
+	}
+}
+
+func TestNewProbeCollectorError(t *testing.T) {
+	for _, s := range []setting.ProbeS{
+		{Module: "tcp", Target: "a:1"},
+		{Name: "a", Module: "icmp", Target: "a"},
+		{Name: "a", Module: "http", Target: "ftp://a"},
+		{Name: "a", Module: "http", Target: "http://a", BodyRegex: "("},
+		{Name: "a", Module: "tcp", Target: "a"},
+	} {
+		if _, err := NewProbeCollector([]setting.ProbeS{s}, 0); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
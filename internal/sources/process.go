@@ -0,0 +1,230 @@
+package sources
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/v3/process"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	processLabels = []string{"name"}
+
+	processUpDesc = prometheus.NewDesc("host_process_up",
+		"Whether at least one process of the watched group is running.", processLabels, nil)
+	processCountDesc = prometheus.NewDesc("host_process_count",
+		"Number of running processes of the watched group.", processLabels, nil)
+	processCPUDesc = prometheus.NewDesc("host_process_cpu_seconds_total",
+		"CPU seconds the processes of the watched group spent in user and system mode.", []string{"name", "mode"}, nil)
+	processRSSDesc = prometheus.NewDesc("host_process_resident_memory_bytes",
+		"Resident memory of the processes of the watched group.", processLabels, nil)
+	processFDsDesc = prometheus.NewDesc("host_process_open_fds",
+		"Open file descriptors of the processes of the watched group.", processLabels, nil)
+	processMaxFDsDesc = prometheus.NewDesc("host_process_max_fds",
+		"Lowest soft limit of open file descriptors among the processes of the watched group.", processLabels, nil)
+	processFDsPercentDesc = prometheus.NewDesc("host_process_fds_used_percent",
+		"Highest percent of its file descriptor limit a process of the watched group has open.", processLabels, nil)
+	processThreadsDesc = prometheus.NewDesc("host_process_threads",
+		"Threads of the processes of the watched group.", processLabels, nil)
+	processStartDesc = prometheus.NewDesc("host_process_start_time_seconds",
+		"Start time of the oldest process of the watched group since unix epoch in seconds.", processLabels, nil)
+)
+
+// ProcessCollector reports the resource usage of groups of processes found by name and
+// command line regexes or by a pidfile, so a service is watched even when its own exporter
+// is down. A group without a running process reports host_process_up 0 and nothing else
+type ProcessCollector struct {
+	watches []processWatch
+}
+
+type processWatch struct {
+	name      string
+	nameRe    *regexp.Regexp
+	cmdlineRe *regexp.Regexp
+	pidfile   string
+}
+
+// NewProcessCollector return a ProcessCollector of the watched groups
+func NewProcessCollector(settings []setting.ProcessS) (*ProcessCollector, error) {
+	c := &ProcessCollector{}
+	names := map[string]bool{}
+
+	for i, s := range settings {
+		if s.Name == "" {
+			return nil, fmt.Errorf("sources.process[%v] has no name", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("sources.process name %q is not unique", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.Pidfile == "" && s.NameRegex == "" && s.CmdlineRegex == "" {
+			return nil, fmt.Errorf("sources.process %q needs one of name_regex, cmdline_regex or pidfile", s.Name)
+		}
+
+		w := processWatch{name: s.Name, pidfile: s.Pidfile}
+		for _, r := range []struct {
+			expr   string
+			target **regexp.Regexp
+		}{{s.NameRegex, &w.nameRe}, {s.CmdlineRegex, &w.cmdlineRe}} {
+			if r.expr == "" {
+				continue
+			}
+			re, err := regexp.Compile(r.expr)
+			if err != nil {
+				return nil, fmt.Errorf("sources.process %q regex %q error: %v", s.Name, r.expr, err)
+			}
+			*r.target = re
+		}
+
+		c.watches = append(c.watches, w)
+	}
+
+	return c, nil
+}
+
+// processes return the running processes of the group, none when the pidfile is missing,
+// names a pid that is gone or, with a regex configured, names a process that does not match
+// it, as when the pid of a stale pidfile has been reused
+func (w processWatch) processes() ([]*process.Process, error) {
+	if w.pidfile != "" {
+		content, err := ioutil.ReadFile(w.pidfile)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("pidfile %v error: %v", w.pidfile, err)
+		}
+
+		p, err := process.NewProcess(int32(pid))
+		if err != nil || !w.matches(p) {
+			return nil, nil
+		}
+		return []*process.Process{p}, nil
+	}
+
+	all, err := process.Processes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*process.Process{}
+	for _, p := range all {
+		if w.matches(p) {
+			result = append(result, p)
+		}
+	}
+
+	return result, nil
+}
+
+// matches report whether p matches the name and cmdline regexes of the group that are set
+func (w processWatch) matches(p *process.Process) bool {
+	if w.nameRe != nil {
+		name, err := p.Name()
+		if err != nil || !w.nameRe.MatchString(name) {
+			return false
+		}
+	}
+	if w.cmdlineRe != nil {
+		cmdline, err := p.Cmdline()
+		if err != nil || !w.cmdlineRe.MatchString(cmdline) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *ProcessCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{processUpDesc, processCountDesc, processCPUDesc, processRSSDesc,
+		processFDsDesc, processMaxFDsDesc, processFDsPercentDesc, processThreadsDesc, processStartDesc} {
+		ch <- desc
+	}
+}
+
+func (c *ProcessCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, w := range c.watches {
+		procs, err := w.processes()
+		if err != nil {
+			global.LogObj.Errorf("process source %v error: %v", w.name, err)
+		}
+
+		var (
+			count, user, system, rss, fds, threads float64
+			maxFDs, fdsPercent, start              float64
+		)
+		for _, p := range procs {
+			// a process that exits while it is read is not counted
+			created, err := p.CreateTime()
+			if err != nil {
+				continue
+			}
+			count++
+			if start == 0 || float64(created)/1000 < start {
+				start = float64(created) / 1000
+			}
+
+			if times, err := p.Times(); err == nil {
+				user, system = user+times.User, system+times.System
+			}
+			if memInfo, err := p.MemoryInfo(); err == nil {
+				rss += float64(memInfo.RSS)
+			}
+			if n, err := p.NumThreads(); err == nil {
+				threads += float64(n)
+			}
+
+			open, err := p.NumFDs()
+			if err != nil {
+				continue
+			}
+			fds += float64(open)
+
+			limits, err := p.Rlimit()
+			if err != nil {
+				continue
+			}
+			for _, limit := range limits {
+				if limit.Resource != process.RLIMIT_NOFILE || limit.Soft == 0 {
+					continue
+				}
+				if maxFDs == 0 || float64(limit.Soft) < maxFDs {
+					maxFDs = float64(limit.Soft)
+				}
+				if percent := float64(open) / float64(limit.Soft) * 100; percent > fdsPercent {
+					fdsPercent = percent
+				}
+			}
+		}
+
+		if count == 0 {
+			ch <- prometheus.MustNewConstMetric(processUpDesc, prometheus.GaugeValue, 0, w.name)
+			ch <- prometheus.MustNewConstMetric(processCountDesc, prometheus.GaugeValue, 0, w.name)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(processUpDesc, prometheus.GaugeValue, 1, w.name)
+		ch <- prometheus.MustNewConstMetric(processCountDesc, prometheus.GaugeValue, count, w.name)
+		ch <- prometheus.MustNewConstMetric(processCPUDesc, prometheus.CounterValue, user, w.name, "user")
+		ch <- prometheus.MustNewConstMetric(processCPUDesc, prometheus.CounterValue, system, w.name, "system")
+		ch <- prometheus.MustNewConstMetric(processRSSDesc, prometheus.GaugeValue, rss, w.name)
+		ch <- prometheus.MustNewConstMetric(processFDsDesc, prometheus.GaugeValue, fds, w.name)
+		if maxFDs > 0 {
+			ch <- prometheus.MustNewConstMetric(processMaxFDsDesc, prometheus.GaugeValue, maxFDs, w.name)
+			ch <- prometheus.MustNewConstMetric(processFDsPercentDesc, prometheus.GaugeValue, fdsPercent, w.name)
+		}
+		ch <- prometheus.MustNewConstMetric(processThreadsDesc, prometheus.GaugeValue, threads, w.name)
+		ch <- prometheus.MustNewConstMetric(processStartDesc, prometheus.GaugeValue, start, w.name)
+	}
+}
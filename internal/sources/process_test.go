@@ -0,0 +1,103 @@
+package sources
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	"github.com/exporterpush/pkg/setting"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gatherValues gather the sources into family name and the name label to value
+func gatherValues(t *testing.T, s *setting.SourcesS) map[string]map[string]float64 {
+	gatherer, err := NewGatherer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]map[string]float64{}
+	for _, mf := range families {
+		result[mf.GetName()] = map[string]float64{}
+		for _, m := range mf.Metric {
+			key := ""
+			for _, lp := range m.Label {
+				key += lp.GetValue() + "/"
+			}
+			value := m.GetGauge().GetValue()
+			if m.Counter != nil {
+				value = m.GetCounter().GetValue()
+			}
+			result[mf.GetName()][key] = value
+		}
+	}
+
+	return result
+}
+
+func TestProcessCollector(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	dir := t.TempDir()
+	pidfile := filepath.Join(dir, "self.pid")
+	if err := ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	values := gatherValues(t, &setting.SourcesS{Process: []setting.ProcessS{
+		{Name: "self", Pidfile: pidfile},
+		{Name: "gone", Pidfile: filepath.Join(dir, "missing.pid")},
+		{Name: "nothing", NameRegex: "^no-such-process-name$"},
+		{Name: "test", CmdlineRegex: filepath.Base(os.Args[0])},
+		{Name: "self-checked", Pidfile: pidfile, CmdlineRegex: filepath.Base(os.Args[0])},
+		// a stale pidfile whose pid now belongs to another program
+		{Name: "reused", Pidfile: pidfile, NameRegex: "^no-such-process-name$"},
+	}})
+
+	for _, name := range []string{"self/", "test/", "self-checked/"} {
+		if values["host_process_up"][name] != 1 {
+			t.Errorf("%v up = %v, want 1", name, values["host_process_up"][name])
+		}
+		if values["host_process_threads"][name] < 1 {
+			t.Errorf("%v threads = %v, want at least 1", name, values["host_process_threads"][name])
+		}
+		if values["host_process_resident_memory_bytes"][name] <= 0 {
+			t.Errorf("%v rss = %v, want more than 0", name, values["host_process_resident_memory_bytes"][name])
+		}
+		if values["host_process_open_fds"][name] < 1 {
+			t.Errorf("%v open fds = %v, want at least 1", name, values["host_process_open_fds"][name])
+		}
+	}
+	if values["host_process_count"]["self/"] != 1 {
+		t.Errorf("self count = %v, want 1", values["host_process_count"]["self/"])
+	}
+
+	for _, name := range []string{"gone/", "nothing/", "reused/"} {
+		if up, ok := values["host_process_up"][name]; !ok || up != 0 {
+			t.Errorf("%v up = %v, %v, want 0", name, up, ok)
+		}
+		if _, ok := values["host_process_threads"][name]; ok {
+			t.Errorf("%v reports threads without a process", name)
+		}
+	}
+}
+
+func TestNewProcessCollectorError(t *testing.T) {
+	for _, settings := range [][]setting.ProcessS{
+		{{NameRegex: "clickhouse"}},
+		{{Name: "ck"}},
+		{{Name: "ck", NameRegex: "("}},
+		{{Name: "ck", Pidfile: "/a"}, {Name: "ck", Pidfile: "/b"}},
+	} {
+		if _, err := NewProcessCollector(settings); err == nil {
+			t.Errorf("expected an error for %+v", settings)
+		}
+	}
+}
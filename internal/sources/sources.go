@@ -0,0 +1,65 @@
+package sources
+
+import (
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// NewGatherer return the gatherer of every source configured in s, it gathers nothing when
+// s is nil. Sources keep state between gathers, so it should be built once
+func NewGatherer(s *setting.SourcesS) (prometheus.Gatherer, error) {
+	registry := prometheus.NewRegistry()
+	gatherers := prometheus.Gatherers{registry}
+	if s == nil {
+		return gatherers, nil
+	}
+
+	if len(s.Process) > 0 {
+		collector, err := NewProcessCollector(s.Process)
+		if err != nil {
+			return nil, err
+		}
+		registry.MustRegister(collector)
+	}
+
+	// every sink gathers once per scrape interval, the ones within half of it share a probe run
+	maxAge := time.Duration(0)
+	if global.GlobalSetting != nil {
+		maxAge = time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second / 2
+	}
+	if len(s.Probe) > 0 {
+		collector, err := NewProbeCollector(s.Probe, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		registry.MustRegister(collector)
+	}
+
+	if s.Textfile.Directory != "" {
+		gatherers = append(gatherers, NewTextfileGatherer(s.Textfile.Directory))
+	}
+
+	// the commands run once per scrape interval, every sink gathers the result of the last run
+	interval := time.Duration(0)
+	if global.GlobalSetting != nil {
+		interval = time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second
+	}
+	names := map[string]bool{}
+	for _, e := range s.Exec {
+		if names[e.Name] {
+			return nil, fmt.Errorf("sources.exec name %q is not unique", e.Name)
+		}
+		names[e.Name] = true
+
+		g, err := NewExecGatherer(e, interval)
+		if err != nil {
+			return nil, err
+		}
+		gatherers = append(gatherers, g)
+	}
+
+	return gatherers, nil
+}
@@ -0,0 +1,204 @@
+package sources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/prom2json"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	textfileMtimeName = "node_textfile_mtime_seconds"
+	textfileErrorName = "node_textfile_scrape_error"
+)
+
+// TextfileGatherer reads the *.prom files of a directory the way the node_exporter textfile
+// collector does, so cron jobs can hand metrics to the agent. It reports the mtime of every
+// file and whether any of them could not be read or parsed. A file that changes while it is
+// read, or does not end with a newline yet, is half-written: the families parsed from it last
+// time are used instead, and it is not counted as an error. A file without the final newline
+// that is unchanged at the next gather is read as it is
+type TextfileGatherer struct {
+	directory string
+
+	mu         sync.Mutex
+	last       map[string]textfile
+	unfinished map[string]fileStamp
+}
+
+type textfile struct {
+	families []*dto.MetricFamily
+	mtime    float64
+}
+
+// fileStamp tells whether a file changed between two reads
+type fileStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// NewTextfileGatherer return a TextfileGatherer of the *.prom files in directory
+func NewTextfileGatherer(directory string) *TextfileGatherer {
+	return &TextfileGatherer{directory: directory, last: map[string]textfile{}, unfinished: map[string]fileStamp{}}
+}
+
+func (g *TextfileGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mtime := &dto.MetricFamily{
+		Name: proto.String(textfileMtimeName),
+		Help: proto.String("Unixtime mtime of textfiles successfully read."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	scrapeError := 0.0
+	familyByName := map[string]*dto.MetricFamily{}
+	current := map[string]textfile{}
+	unfinished := map[string]fileStamp{}
+
+	paths, err := filepath.Glob(filepath.Join(g.directory, "*.prom"))
+	if err == nil {
+		_, err = os.Stat(g.directory)
+	}
+	if err != nil {
+		global.LogObj.Errorf("textfile source read directory %v error: %v", g.directory, err)
+		scrapeError = 1
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		// editors and writers that rename into place keep their temporary files hidden
+		if strings.HasPrefix(filepath.Base(path), ".") {
+			continue
+		}
+
+		file, stamp, err := readTextfile(path, g.unfinished[path])
+		if err == errHalfWritten {
+			unfinished[path] = stamp
+			last, ok := g.last[path]
+			if !ok {
+				continue
+			}
+			file = last
+		} else if err != nil {
+			global.LogObj.Errorf("textfile source %v error: %v", path, err)
+			scrapeError = 1
+			continue
+		}
+		current[path] = file
+
+		if err := mergeFamilies(familyByName, file.families); err != nil {
+			global.LogObj.Errorf("textfile source %v error: %v", path, err)
+			scrapeError = 1
+			continue
+		}
+		mtime.Metric = append(mtime.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("file"), Value: proto.String(filepath.Base(path))}},
+			Gauge: &dto.Gauge{Value: proto.Float64(file.mtime)},
+		})
+	}
+	g.last, g.unfinished = current, unfinished
+
+	result := []*dto.MetricFamily{}
+	for _, mf := range familyByName {
+		result = append(result, mf)
+	}
+	if len(mtime.Metric) > 0 {
+		result = append(result, mtime)
+	}
+	result = append(result, &dto.MetricFamily{
+		Name:   proto.String(textfileErrorName),
+		Help:   proto.String("1 if there was an error opening or reading a file, 0 otherwise"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(scrapeError)}}},
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+
+	return result, nil
+}
+
+var errHalfWritten = errors.New("file is being written")
+
+// readTextfile parse one file and return its families and mtime in seconds, with the stamp of
+// the file. A file without the final newline is errHalfWritten unless its stamp is still
+// unfinished, the one it had when it was found half-written before
+func readTextfile(path string, unfinished fileStamp) (textfile, fileStamp, error) {
+	before, err := os.Stat(path)
+	if err != nil {
+		return textfile{}, fileStamp{}, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return textfile{}, fileStamp{}, err
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		return textfile{}, fileStamp{}, err
+	}
+	stamp := fileStamp{size: after.Size(), mtime: after.ModTime()}
+
+	if !before.ModTime().Equal(after.ModTime()) || before.Size() != after.Size() || int64(len(content)) != after.Size() {
+		return textfile{}, stamp, errHalfWritten
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		if stamp.size != unfinished.size || !stamp.mtime.Equal(unfinished.mtime) {
+			return textfile{}, stamp, errHalfWritten
+		}
+		global.LogObj.Warnf("textfile source %v does not end with a newline and did not change since the last gather, read as it is", path)
+		// the text format parser needs the final newline
+		content = append(content, '\n')
+	}
+
+	mfChan := make(chan *dto.MetricFamily, 1024)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- prom2json.ParseReader(bytes.NewReader(content), mfChan)
+	}()
+
+	families := []*dto.MetricFamily{}
+	for mf := range mfChan {
+		families = append(families, mf)
+	}
+	if err := <-errChan; err != nil {
+		return textfile{}, stamp, err
+	}
+
+	return textfile{families: families, mtime: float64(after.ModTime().UnixNano()) / 1e9}, stamp, nil
+}
+
+// mergeFamilies add the series of families to familyByName, a family whose type differs from
+// the one another file has under the same name is an error and nothing of families is added
+func mergeFamilies(familyByName map[string]*dto.MetricFamily, families []*dto.MetricFamily) error {
+	for _, mf := range families {
+		if mf.GetName() == textfileMtimeName || mf.GetName() == textfileErrorName {
+			return fmt.Errorf("family %v is reserved for the textfile source", mf.GetName())
+		}
+		if existing, ok := familyByName[mf.GetName()]; ok && existing.GetType() != mf.GetType() {
+			return fmt.Errorf("family %v is %v here and %v in another file", mf.GetName(), mf.GetType(), existing.GetType())
+		}
+	}
+
+	for _, mf := range families {
+		existing, ok := familyByName[mf.GetName()]
+		if !ok {
+			existing = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			familyByName[mf.GetName()] = existing
+		}
+		// the sinks may set labels on the series, the parsed ones are kept for half-written files
+		for _, m := range mf.Metric {
+			existing.Metric = append(existing.Metric, proto.Clone(m).(*dto.Metric))
+		}
+	}
+
+	return nil
+}
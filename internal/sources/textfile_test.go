@@ -0,0 +1,113 @@
+package sources
+
+import (
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/pkg/logger"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func familyByName(families []*dto.MetricFamily) map[string]*dto.MetricFamily {
+	result := map[string]*dto.MetricFamily{}
+	for _, mf := range families {
+		result[mf.GetName()] = mf
+	}
+
+	return result
+}
+
+func TestTextfileGatherer(t *testing.T) {
+	global.LogObj = logger.NewLogger(ioutil.Discard, "", log.LstdFlags)
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("backup.prom", "# TYPE backup_last_success_seconds gauge\nbackup_last_success_seconds{db=\"a\"} 100\n")
+	write("cron.prom", "# TYPE cron_runs_total counter\ncron_runs_total 3\n# TYPE backup_last_success_seconds gauge\nbackup_last_success_seconds{db=\"b\"} 200\n")
+	write("ignored.txt", "not_read 1\n")
+	write(".hidden.prom", "not_read 1\n")
+
+	g := NewTextfileGatherer(dir)
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := familyByName(families)
+
+	if n := len(byName["backup_last_success_seconds"].GetMetric()); n != 2 {
+		t.Errorf("backup_last_success_seconds has %v series, want 2 merged from both files", n)
+	}
+	if byName["cron_runs_total"].GetMetric()[0].GetCounter().GetValue() != 3 {
+		t.Errorf("cron_runs_total = %v, want 3", byName["cron_runs_total"])
+	}
+	if _, ok := byName["not_read"]; ok {
+		t.Error("read a file that is hidden or not *.prom")
+	}
+	if n := len(byName[textfileMtimeName].GetMetric()); n != 2 {
+		t.Errorf("%v has %v series, want 2", textfileMtimeName, n)
+	}
+	if v := byName[textfileErrorName].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("%v = %v, want 0", textfileErrorName, v)
+	}
+
+	// a half-written file keeps the series of the previous read and is no error
+	write("cron.prom", "# TYPE cron_runs_total counter\ncron_runs_total 4\ncron_runs")
+	byName = familyByName(mustGather(t, g))
+	if byName["cron_runs_total"].GetMetric()[0].GetCounter().GetValue() != 3 {
+		t.Errorf("cron_runs_total = %v, want the previous 3", byName["cron_runs_total"])
+	}
+	if v := byName[textfileErrorName].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("%v = %v, want 0 for a half-written file", textfileErrorName, v)
+	}
+
+	// unchanged at the next gather, it is read without the final newline and fails to parse
+	byName = familyByName(mustGather(t, g))
+	if _, ok := byName["cron_runs_total"]; ok {
+		t.Error("kept the series of a file still without its final newline after a gather")
+	}
+	if v := byName[textfileErrorName].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("%v = %v, want 1 for a file that stays half-written", textfileErrorName, v)
+	}
+
+	// a generator that never writes the final newline is read after one gather
+	write("cron.prom", "# TYPE cron_runs_total counter\ncron_runs_total 5")
+	mustGather(t, g)
+	byName = familyByName(mustGather(t, g))
+	if byName["cron_runs_total"].GetMetric()[0].GetCounter().GetValue() != 5 {
+		t.Errorf("cron_runs_total = %v, want 5 of the file without a final newline", byName["cron_runs_total"])
+	}
+
+	// a broken file is dropped and reported
+	write("cron.prom", "cron_runs_total{ 4\n")
+	byName = familyByName(mustGather(t, g))
+	if _, ok := byName["cron_runs_total"]; ok {
+		t.Error("kept the series of a file that does not parse")
+	}
+	if v := byName[textfileErrorName].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("%v = %v, want 1", textfileErrorName, v)
+	}
+	if n := len(byName["backup_last_success_seconds"].GetMetric()); n != 1 {
+		t.Errorf("backup_last_success_seconds has %v series, want 1 from the good file", n)
+	}
+
+	// a missing directory is an error
+	byName = familyByName(mustGather(t, NewTextfileGatherer(filepath.Join(dir, "missing"))))
+	if v := byName[textfileErrorName].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("%v = %v, want 1 for a missing directory", textfileErrorName, v)
+	}
+}
+
+func mustGather(t *testing.T, g *TextfileGatherer) []*dto.MetricFamily {
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return families
+}
@@ -0,0 +1,168 @@
+package stdout_push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/scrape"
+	"github.com/exporterpush/internal/self_metrics"
+	"github.com/exporterpush/pkg/prom2json"
+	promclient "github.com/exporterpush/pkg/prometheus-remote-client"
+	"github.com/exporterpush/pkg/util"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FormatText        = "text"         // prometheus text exposition
+	FormatJSON        = "json"         // indented json
+	FormatRemoteWrite = "remote_write" // decoded prompb.WriteRequest as indented json
+)
+
+var (
+	// Out is where payloads are printed, sinks run concurrently so every payload is written under mu
+	Out io.Writer = os.Stdout
+	mu  sync.Mutex
+)
+
+func StdoutPush() {
+	defer util.CatchException(func(e interface{}) {
+		global.LogObj.Panic(e)
+	})
+
+	intervalTime := time.Duration(global.GlobalSetting.ScrapeInterval) * time.Second
+	ticker := time.NewTicker(intervalTime)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			begin := time.Now()
+			err := StdoutPushOnce()
+			self_metrics.ObserveCycle("stdout", begin, err)
+			if err != nil {
+				global.LogObj.Error(err)
+			}
+		}
+	}
+}
+
+// StdoutPushOnce scrape node_exporter and the sources and print the points one time
+func StdoutPushOnce() error {
+	metricPointList, err := scrape.SinkMetricPointList(global.StdoutSetting.Labels)
+	if err != nil {
+		return err
+	}
+
+	if err := PrintMetricPointList("stdout", "", global.StdoutSetting.Format, metricPointList); err != nil {
+		return fmt.Errorf("print metric points to stdout error:%v", err)
+	}
+
+	return nil
+}
+
+// PrintMetricPointList print the points a sink would send to dest in the given format
+func PrintMetricPointList(sink, dest, format string, metricPointList []global.MetricPoint) error {
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case FormatText:
+		buf.Write(prom2json.MetricPointListToText(metricPointList))
+
+	case FormatJSON:
+		body, err := json.MarshalIndent(metricPointList, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(body)
+		buf.WriteString("\n")
+
+	case FormatRemoteWrite:
+		writeReq, err := promclient.MetricPointList(metricPointList).ToWriteRequest()
+		if err != nil {
+			return err
+		}
+		body, err := json.MarshalIndent(writeReq, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(body)
+		buf.WriteString("\n")
+
+	default:
+		return fmt.Errorf("unknown stdout format %q", format)
+	}
+
+	return output(sink, dest, buf.Bytes())
+}
+
+// PrintMetricFamilies print the metric families a sink would send to dest in the given format
+func PrintMetricFamilies(sink, dest, format string, families []*dto.MetricFamily) error {
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case FormatText:
+		for _, mf := range families {
+			if _, err := expfmt.MetricFamilyToText(buf, mf); err != nil {
+				return err
+			}
+		}
+
+	case FormatJSON:
+		familyList := []*prom2json.Family{}
+		for _, mf := range families {
+			_, family := prom2json.NewFamily(mf)
+			familyList = append(familyList, family)
+		}
+		body, err := json.MarshalIndent(familyList, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(body)
+		buf.WriteString("\n")
+
+	case FormatRemoteWrite:
+		metricPointList := []global.MetricPoint{}
+		for _, mf := range families {
+			metricPointList = append(metricPointList, prom2json.NewMetricPointList(mf, nil)...)
+		}
+		return PrintMetricPointList(sink, dest, format, metricPointList)
+
+	default:
+		return fmt.Errorf("unknown stdout format %q", format)
+	}
+
+	return output(sink, dest, buf.Bytes())
+}
+
+// PrintJSON print a json request body a sink would send to dest, indented for reading
+func PrintJSON(sink, dest string, body []byte) error {
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, body, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+
+	return output(sink, dest, buf.Bytes())
+}
+
+func output(sink, dest string, body []byte) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	header := fmt.Sprintf("# sink=%v time=%v", sink, time.Now().Format(time.RFC3339))
+	if dest != "" {
+		header = fmt.Sprintf("# sink=%v destination=%v time=%v", sink, dest, time.Now().Format(time.RFC3339))
+	}
+
+	if _, err := fmt.Fprintln(Out, header); err != nil {
+		return err
+	}
+	_, err := Out.Write(body)
+	return err
+}
@@ -0,0 +1,37 @@
+package stdout_push
+
+import (
+	"bytes"
+	"github.com/exporterpush/global"
+	"strings"
+	"testing"
+)
+
+func TestPrintMetricPointList(t *testing.T) {
+	points := []global.MetricPoint{
+		{Metric: "node_load1", LabelMap: map[string]string{"cluster_name": "test"}, Time: 1650000000, Value: 0.5},
+	}
+
+	want := map[string]string{
+		FormatText:        `node_load1{cluster_name="test"} 0.5 1650000000000`,
+		FormatJSON:        `"cluster_name": "test"`,
+		FormatRemoteWrite: `"name": "__name__"`,
+	}
+
+	for format, substr := range want {
+		buf := &bytes.Buffer{}
+		Out = buf
+
+		if err := PrintMetricPointList("prometheus", "http://127.0.0.1:9090/api/v1/write", format, points); err != nil {
+			t.Fatalf("%v print error: %v", format, err)
+		}
+
+		out := buf.String()
+		if !strings.HasPrefix(out, "# sink=prometheus destination=http://127.0.0.1:9090/api/v1/write") {
+			t.Errorf("%v output has no sink header: %v", format, out)
+		}
+		if !strings.Contains(out, substr) {
+			t.Errorf("%v output does not contain %q: %v", format, substr, out)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	_ "github.com/exporterpush/config"
 	"github.com/exporterpush/global"
+	"github.com/exporterpush/internal/file_push"
 	"github.com/exporterpush/internal/server"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,13 +14,50 @@ import (
 
 func main() {
 
+	switch flag.Arg(0) {
+	case "":
+	case "once":
+		if !server.RunOnce() {
+			os.Exit(1)
+		}
+		return
+	case "replay":
+		if err := replay(flag.Args()[1:]); err != nil {
+			log.Fatalf("replay err: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
 	server.Run()
 
 	// wait syscall signal
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	sigInfo := <-quit
 
 	global.LogObj.Errorf("Shutting down server get signal info: %v", sigInfo)
 
+	server.Shutdown()
+
+}
+
+// replay send the files written by the file sink to a remote write endpoint
+func replay(args []string) error {
+	var url string
+	if len(global.PrometheusSetting.StaticConfigs) > 0 && len(global.PrometheusSetting.StaticConfigs[0].Destination) > 0 {
+		url = global.PrometheusSetting.StaticConfigs[0].Destination[0]
+	}
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dir := fs.String("dir", global.FileSetting.Path, "要回放的文件所在目录")
+	name := fs.String("file-name", global.FileSetting.FileName, "要回放的文件名(不含后缀)")
+	format := fs.String("format", global.FileSetting.Format, "文件格式: text, ndjson, remote_write")
+	fs.StringVar(&url, "url", url, "prometheus remote write 地址")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return file_push.Replay(*dir, *name, *format, url)
 }
@@ -0,0 +1,186 @@
+package hostfacts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	metadataSource string
+	metadataCache  = map[string]string{}
+	metadataMu     sync.Mutex
+	metadataClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+// SetMetadataSource set where the metadata template function reads instance metadata from:
+// an http url, where key is fetched from source/key like a cloud metadata service, or
+// the path of a json file with a flat object of string values
+func SetMetadataSource(source string) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	metadataSource = strings.TrimSuffix(source, "/")
+	metadataCache = map[string]string{}
+}
+
+// Metadata return the instance metadata value of key. Values fetched from an url are cached
+// since they do not change while the host runs, a file is read again on every call
+func Metadata(key string) (string, error) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	if metadataSource == "" {
+		return "", fmt.Errorf("metadata %q requested but global.metadata_source is not set", key)
+	}
+
+	if !strings.HasPrefix(metadataSource, "http://") && !strings.HasPrefix(metadataSource, "https://") {
+		content, err := ioutil.ReadFile(metadataSource)
+		if err != nil {
+			return "", fmt.Errorf("read metadata file error: %v", err)
+		}
+
+		values := map[string]string{}
+		if err := json.Unmarshal(content, &values); err != nil {
+			return "", fmt.Errorf("parse metadata file %v error: %v", metadataSource, err)
+		}
+
+		value, ok := values[key]
+		if !ok {
+			return "", fmt.Errorf("metadata file %v has no key %q", metadataSource, key)
+		}
+		return value, nil
+	}
+
+	if value, ok := metadataCache[key]; ok {
+		return value, nil
+	}
+
+	response, err := metadataClient.Get(metadataSource + "/" + key)
+	if err != nil {
+		return "", fmt.Errorf("request metadata %q error: %v", key, err)
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request metadata %q response code:%v", key, response.StatusCode)
+	}
+
+	value := strings.TrimSpace(string(body))
+	metadataCache[key] = value
+
+	return value, nil
+}
+
+// Hostname return the host name, empty when it can not be read
+func Hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	return name
+}
+
+// IP return the first non-loopback IPv4 address of the host
+func IP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+
+	return ""
+}
+
+// FuncMap return the host fact template functions, label reads from labels
+func FuncMap(labels map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"hostname": Hostname,
+		"ip":       IP,
+		"env":      os.Getenv,
+		"metadata": Metadata,
+		"label": func(name string) string {
+			return labels[name]
+		},
+	}
+}
+
+// Render execute a text/template against the host facts and the target labels,
+// e.g. "{{hostname}}", "{{ip}}", `{{env "DC"}}`, `{{metadata "instance-id"}}`, `{{label "cluster_name"}}`
+// or "{{.Labels.cluster_name}}". A value without "{{" is returned as is
+func Render(text string, labels map[string]string) (string, error) {
+	return RenderFuncs(text, labels, nil)
+}
+
+// RenderFuncs is Render with extra template functions, which may replace the default ones
+func RenderFuncs(text string, labels map[string]string, funcs template.FuncMap) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	t, err := parse(text, labels, funcs)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, struct{ Labels map[string]string }{Labels: labels}); err != nil {
+		return "", fmt.Errorf("execute template %q error: %v", text, err)
+	}
+
+	return buf.String(), nil
+}
+
+// Check parse text like RenderFuncs without executing it, so a bad template is found
+// before any value is rendered
+func Check(text string, funcs template.FuncMap) error {
+	if !strings.Contains(text, "{{") {
+		return nil
+	}
+
+	_, err := parse(text, nil, funcs)
+	return err
+}
+
+func parse(text string, labels map[string]string, funcs template.FuncMap) (*template.Template, error) {
+	funcMap := FuncMap(labels)
+	for name, f := range funcs {
+		funcMap[name] = f
+	}
+
+	t, err := template.New("").Option("missingkey=zero").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template %q error: %v", text, err)
+	}
+
+	return t, nil
+}
+
+// RenderMap render every value of m, the keys are kept as they are
+func RenderMap(m map[string]string, labels map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		rendered, err := Render(v, labels)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = rendered
+	}
+
+	return result, nil
+}
@@ -0,0 +1,88 @@
+package hostfacts
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	os.Setenv("HOSTFACTS_TEST_DC", "gz")
+	defer os.Unsetenv("HOSTFACTS_TEST_DC")
+
+	labels := map[string]string{"cluster_name": "test"}
+	cases := map[string]string{
+		"static":                           "static",
+		"{{hostname}}":                     Hostname(),
+		`{{env "HOSTFACTS_TEST_DC"}}-node`: "gz-node",
+		`{{label "cluster_name"}}`:         "test",
+		"{{.Labels.cluster_name}}":         "test",
+		"{{.Labels.missing}}":              "",
+	}
+
+	for text, want := range cases {
+		got, err := Render(text, labels)
+		if err != nil {
+			t.Fatalf("render %q error: %v", text, err)
+		}
+		if got != want {
+			t.Errorf("render %q = %q, want %q", text, got, want)
+		}
+	}
+
+	if _, err := Render("{{hostname", labels); err == nil {
+		t.Error("expected an error for a broken template")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/latest/meta-data/instance-id" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ins-123\n"))
+	}))
+	defer server.Close()
+
+	SetMetadataSource(server.URL + "/latest/meta-data/")
+	defer SetMetadataSource("")
+
+	for i := 0; i < 2; i++ {
+		got, err := Render(`{{metadata "instance-id"}}`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "ins-123" {
+			t.Errorf("metadata instance-id = %q, want ins-123", got)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("metadata url requested %v times, want the value cached", requests)
+	}
+
+	if _, err := Render(`{{metadata "zone"}}`, nil); err == nil {
+		t.Error("expected an error for a missing metadata key")
+	}
+
+	file := filepath.Join(t.TempDir(), "metadata.json")
+	if err := ioutil.WriteFile(file, []byte(`{"instance-id":"ins-456"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetMetadataSource(file)
+
+	got, err := RenderFuncs(`{{metadata "instance-id"}}-{{scraped "port"}}`, nil, map[string]interface{}{
+		"scraped": func(name string) string { return "9000" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ins-456-9000" {
+		t.Errorf("render = %q, want ins-456-9000", got)
+	}
+}
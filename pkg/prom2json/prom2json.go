@@ -1,6 +1,7 @@
 package prom2json
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/exporterpush/global"
@@ -11,7 +12,9 @@ import (
 	"mime"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -142,6 +145,46 @@ func NewMetricPointList(dtoMF *dto.MetricFamily, addLabel map[string]string) []g
 	return tsList
 }
 
+// MetricPointListToText render []MetricPoint as prometheus text exposition lines
+// `name{k="v"} value timestamp_ms`, labels are sorted so the output is stable
+func MetricPointListToText(metricPointList []global.MetricPoint) []byte {
+	buf := &bytes.Buffer{}
+
+	for _, point := range metricPointList {
+		buf.WriteString(point.Metric)
+
+		if len(point.LabelMap) > 0 {
+			keys := make([]string, 0, len(point.LabelMap))
+			for k := range point.LabelMap {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			buf.WriteString("{")
+			for i, k := range keys {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				buf.WriteString(k)
+				buf.WriteString(`="`)
+				buf.WriteString(labelValueEscaper.Replace(point.LabelMap[k]))
+				buf.WriteString(`"`)
+			}
+			buf.WriteString("}")
+		}
+
+		buf.WriteString(" ")
+		buf.WriteString(strconv.FormatFloat(point.Value, 'g', -1, 64))
+		buf.WriteString(" ")
+		buf.WriteString(strconv.FormatInt(point.Time*1000, 10))
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
 func getValue(m *dto.Metric) float64 {
 	switch {
 	case m.Gauge != nil:
@@ -358,38 +401,6 @@ func GetProm2JsonStruct(exporter_url string) []*Family {
 	return result
 }
 
-// GetProm2MetricPointList get exporter info and parsing into MetricPoint struct return slice data
-func GetProm2MetricPointList(exporter_url string, adddLabel map[string]string) []global.MetricPoint {
-	transport, err := makeTransport("", "", false)
-	if err != nil {
-		global.LogObj.Error(err)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	mfChan := make(chan *dto.MetricFamily, 1024)
-
-	go func() {
-		err := FetchMetricFamilies(exporter_url, mfChan, transport)
-		if err != nil {
-			global.LogObj.Error(err)
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-	}()
-
-	result := []global.MetricPoint{}
-	for mf := range mfChan {
-		metricObj := NewMetricPointList(mf, adddLabel)
-		if len(metricObj) > 0 {
-			for _, point := range metricObj {
-				result = append(result, point)
-			}
-		}
-	}
-
-	return result
-}
-
 type TransFormGather struct {
 	exporter_url string
 }
@@ -402,19 +413,13 @@ func NewTransFormGather(url string) *TransFormGather {
 func (t TransFormGather) Gather() ([]*dto.MetricFamily, error) {
 	transport, err := makeTransport("", "", false)
 	if err != nil {
-		global.LogObj.Error(err)
-		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
 	mfChan := make(chan *dto.MetricFamily, 1024)
+	errChan := make(chan error, 1)
 
 	go func() {
-		err := FetchMetricFamilies(t.exporter_url, mfChan, transport)
-		if err != nil {
-			global.LogObj.Error(err)
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
+		errChan <- FetchMetricFamilies(t.exporter_url, mfChan, transport)
 	}()
 
 	result := []*dto.MetricFamily{}
@@ -422,5 +427,9 @@ func (t TransFormGather) Gather() ([]*dto.MetricFamily, error) {
 		result = append(result, mf)
 	}
 
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
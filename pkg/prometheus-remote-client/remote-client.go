@@ -327,6 +327,21 @@ func (items MetricPointList) convertMetricPointToWriteRequest() (err error, writ
 	return nil, &prompb.WriteRequest{Timeseries: ts}
 }
 
+// ToWriteRequest converts the []MetricPoint to a Prometheus proto write request,
+// it is the same conversion WriteMetricPointList does before sending
+func (items MetricPointList) ToWriteRequest() (*prompb.WriteRequest, error) {
+	err, writeReq := items.convertMetricPointToWriteRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if writeReq == nil {
+		writeReq = &prompb.WriteRequest{}
+	}
+
+	return writeReq, nil
+}
+
 func convertPromTimeSeries(item global.MetricPoint) (prompb.TimeSeries, error) {
 	pt := prompb.TimeSeries{}
 	pt.Samples = []prompb.Sample{{}}
@@ -0,0 +1,137 @@
+package rate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sample is the last value seen for a key
+type Sample struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// Tracker turns successive samples of a value into deltas and per-second rates.
+// Counter samples are reset aware the way Prometheus rate() is: a value lower than the
+// previous one means the counter restarted from zero, so the new value itself is the increase.
+// The last samples can be persisted so a restarted agent continues where it stopped
+type Tracker struct {
+	// MaxAge drops a previous sample older than it, and Save forgets the keys not sampled
+	// within it, 0 keeps samples of any age
+	MaxAge time.Duration
+
+	mu   sync.Mutex
+	last map[string]Sample
+	path string
+}
+
+// NewTracker return a Tracker persisting to path, the state saved there earlier is
+// loaded. An empty path keeps the state in memory only
+func NewTracker(path string) (*Tracker, error) {
+	t := &Tracker{last: map[string]Sample{}, path: path}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+
+	if err := json.Unmarshal(data, &t.last); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// Delta record value for key at now and return the increase since the previous sample
+// and the real time elapsed between them. ok is false for the first sample of a key, for a
+// previous sample older than MaxAge and when time did not move forward
+func (t *Tracker) Delta(key string, value float64, now time.Time, counter bool) (delta float64, elapsed time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, seen := t.last[key]
+	t.last[key] = Sample{Value: value, Time: now}
+	if !seen {
+		return 0, 0, false
+	}
+
+	elapsed = now.Sub(prev.Time)
+	if elapsed <= 0 || (t.MaxAge > 0 && elapsed > t.MaxAge) {
+		return 0, elapsed, false
+	}
+
+	delta = value - prev.Value
+	if counter && value < prev.Value {
+		delta = value
+	}
+
+	return delta, elapsed, true
+}
+
+// Rate record value for key at now and return its per-second rate over the real elapsed time
+func (t *Tracker) Rate(key string, value float64, now time.Time, counter bool) (float64, bool) {
+	delta, elapsed, ok := t.Delta(key, value, now, counter)
+	if !ok {
+		return 0, false
+	}
+
+	return delta / elapsed.Seconds(), true
+}
+
+// Save forget the keys of series gone for longer than MaxAge and write the last samples to
+// the tracker path, through a temporary file so a crash never leaves a truncated state behind
+func (t *Tracker) Save() error {
+	t.mu.Lock()
+	t.prune()
+	if t.path == "" {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.last)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.path)
+}
+
+// prune delete the samples older than MaxAge, measured from the newest sample so a clock
+// jump or a long stop of the agent does not drop every key at once
+func (t *Tracker) prune() {
+	if t.MaxAge <= 0 {
+		return
+	}
+
+	newest := time.Time{}
+	for _, sample := range t.last {
+		if sample.Time.After(newest) {
+			newest = sample.Time
+		}
+	}
+
+	for key, sample := range t.last {
+		if newest.Sub(sample.Time) > t.MaxAge {
+			delete(t.last, key)
+		}
+	}
+}
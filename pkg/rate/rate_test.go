@@ -0,0 +1,103 @@
+package rate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrackerRate(t *testing.T) {
+	tracker, _ := NewTracker("")
+	start := time.Unix(1650000000, 0)
+
+	if _, ok := tracker.Rate("query", 100, start, true); ok {
+		t.Error("first sample has no rate")
+	}
+
+	// the rate uses the real 20s elapsed, not the configured interval
+	if r, ok := tracker.Rate("query", 500, start.Add(20*time.Second), true); !ok || r != 20 {
+		t.Errorf("rate = %v %v, want 20", r, ok)
+	}
+
+	// clickhouse restarted: the counter starts again from zero
+	if r, ok := tracker.Rate("query", 30, start.Add(30*time.Second), true); !ok || r != 3 {
+		t.Errorf("rate after reset = %v %v, want 3", r, ok)
+	}
+
+	// a gauge going down is a real decrease
+	tracker.Delta("parts", 10, start, false)
+	if d, _, ok := tracker.Delta("parts", 4, start.Add(15*time.Second), false); !ok || d != -6 {
+		t.Errorf("gauge delta = %v %v, want -6", d, ok)
+	}
+}
+
+func TestTrackerMaxAge(t *testing.T) {
+	tracker, _ := NewTracker("")
+	tracker.MaxAge = time.Minute
+	start := time.Unix(1650000000, 0)
+
+	tracker.Rate("query", 100, start, true)
+	if _, ok := tracker.Rate("query", 200, start.Add(time.Hour), true); ok {
+		t.Error("rate over a sample older than MaxAge")
+	}
+}
+
+func TestTrackerPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "barad.json")
+	tracker, _ := NewTracker(path)
+	tracker.MaxAge = time.Minute
+	start := time.Unix(1650000000, 0)
+
+	// sdb is unplugged after the first sample, sda keeps being sampled
+	tracker.Rate("sda", 100, start, true)
+	tracker.Rate("sdb", 100, start, true)
+	tracker.Rate("sda", 200, start.Add(2*time.Minute), true)
+	if err := tracker.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.last) != 1 {
+		t.Errorf("saved state = %v, want only sda", reloaded.last)
+	}
+	if _, ok := tracker.last["sdb"]; ok {
+		t.Error("sdb is still tracked")
+	}
+}
+
+func TestTrackerPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state", "barad.json")
+	start := time.Unix(1650000000, 0)
+
+	before, _ := NewTracker(path)
+	before.Rate("query", 100, start, true)
+	if err := before.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted agent keeps the previous sample instead of emitting a spike or nothing
+	after, err := NewTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := after.Rate("query", 160, start.Add(15*time.Second), true); !ok || r != 4 {
+		t.Errorf("rate after restart = %v %v, want 4", r, ok)
+	}
+}
@@ -2,6 +2,8 @@ package setting
 
 import (
 	"github.com/spf13/viper"
+	"io"
+	"time"
 )
 
 /*
@@ -12,7 +14,11 @@ type GlobalS struct {
 	ScrapeInterval    int8             `mapstructure:"scrape_interval"`
 	Disk              string           `mapstructure:"disk"`
 	NetInterface      string           `mapstructure:"net_interface"`
+	MetadataSource    string           `mapstructure:"metadata_source"`
+	Devices           hostDevices      `mapstructure:"devices"`
+	CgroupRoot        string           `mapstructure:"cgroup_root"`
 	ScrapeTargetTypes scrapeTargetType `mapstructure:"scrape_target_types"`
+	Clickhouse        ClickhouseS      `mapstructure:"clickhouse"`
 	LogSetting        log              `mapstructure:"log"`
 }
 
@@ -21,6 +27,27 @@ type scrapeTargetType struct {
 	ClickhouseExporter string `mapstructure:"clickhouse_exporter"`
 }
 
+// ClickhouseS is the server the builtin://clickhouse collector reads the system tables of
+type ClickhouseS struct {
+	URL      string `mapstructure:"url"` // HTTP interface, http://127.0.0.1:8123 by default
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	Timeout  int    `mapstructure:"timeout"` // seconds per query
+}
+
+// hostDevices select the disks, mountpoints and interfaces the host metrics are collected for
+type hostDevices struct {
+	Disks       HostFilter `mapstructure:"disks"`
+	Mountpoints HostFilter `mapstructure:"mountpoints"`
+	Interfaces  HostFilter `mapstructure:"interfaces"`
+}
+
+// HostFilter patterns are globs, or anchored regexes when prefixed with ~
+type HostFilter struct {
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+}
+
 type log struct {
 	LogSavePath string `mapstructure:"log_save_path"`
 	LogFileName string `mapstructure:"log_file_name"`
@@ -37,24 +64,202 @@ type staticConfig struct {
 }
 
 type BaradS struct {
-	IsUse         bool           `mapstructure:"is_use"`
-	AppId         string         `mapstructure:"app_id"`
-	InstanceId    string         `mapstructure:"instance_id"`
-	NodeId        string         `mapstructure:"node_id"`
-	ProjectId     string         `mapstructure:"project_id"`
-	Namespace     string         `mapstructure:"namespace"`
-	StaticConfigs []staticConfig `mapstructure:"static_configs"`
+	IsUse         bool              `mapstructure:"is_use"`
+	MappingFile   string            `mapstructure:"mapping_file"`
+	StateFile     string            `mapstructure:"state_file"`
+	Timeout       int               `mapstructure:"timeout"`
+	Retries       int               `mapstructure:"retries"`
+	RetryBackoff  int               `mapstructure:"retry_backoff"`
+	SpoolDir      string            `mapstructure:"spool_dir"`
+	SpoolMaxFiles int               `mapstructure:"spool_max_files"`
+	AppId         string            `mapstructure:"app_id"`
+	InstanceId    string            `mapstructure:"instance_id"`
+	NodeId        string            `mapstructure:"node_id"`
+	ProjectId     string            `mapstructure:"project_id"`
+	Dimensions    map[string]string `mapstructure:"dimensions"` // extra dimensions beyond the four fixed ones
+	Namespace     string            `mapstructure:"namespace"`
+	StaticConfigs []staticConfig    `mapstructure:"static_configs"`
+}
+
+// BaradMetricMapping describes how one barad batch entry is calculated from the scraped metrics
+type BaradMetricMapping struct {
+	Name        string         `mapstructure:"name"`
+	Unit        string         `mapstructure:"unit"`
+	Source      MetricSelector `mapstructure:"source"`
+	Divisor     MetricSelector `mapstructure:"divisor"`     // only used by the ratio transform
+	Aggregation string         `mapstructure:"aggregation"` // sum, avg, max, min or count across the selected series
+	Transform   string         `mapstructure:"transform"`   // raw, delta, rate or ratio
+	Scale       float64        `mapstructure:"scale"`
+	Precision   *int           `mapstructure:"precision"`
+}
+
+type MetricSelector struct {
+	Metric string            `mapstructure:"metric"`
+	Labels map[string]string `mapstructure:"labels"` // "v" or "=v", "!=v", "=~regex", "!~regex"
+	Field  string            `mapstructure:"field"`  // sum or count of summary and histogram series
 }
 
 type PrometheusS struct {
 	IsUse         bool           `mapstructure:"is_use"`
 	StaticConfigs []staticConfig `mapstructure:"static_configs"`
+	DestinationSD DestinationSDS `mapstructure:"destination_sd"` // failover by default
 }
 
 type PushgatewayS struct {
-	IsUse         bool           `mapstructure:"is_use"`
-	JobnName      string         `mapstructure:"job_name"`
-	StaticConfigs []staticConfig `mapstructure:"static_configs"`
+	IsUse            bool              `mapstructure:"is_use"`
+	JobnName         string            `mapstructure:"job_name"`
+	Method           string            `mapstructure:"method"`
+	DeleteOnShutdown bool              `mapstructure:"delete_on_shutdown"`
+	Grouping         map[string]string `mapstructure:"grouping"`
+	StaticConfigs    []staticConfig    `mapstructure:"static_configs"`
+	DestinationSD    DestinationSDS    `mapstructure:"destination_sd"` // fanout by default
+}
+
+// HttpJsonS is one http_json sink, posting a json body rendered from the scraped points
+type HttpJsonS struct {
+	IsUse         bool              `mapstructure:"is_use"`
+	Name          string            `mapstructure:"name"`
+	Preset        string            `mapstructure:"preset"` // fills the unset request fields, e.g. barad
+	Method        string            `mapstructure:"method"`
+	Headers       map[string]string `mapstructure:"headers"`
+	Template      string            `mapstructure:"template"`     // text/template rendering the whole body
+	Mapping       map[string]string `mapstructure:"mapping"`      // json key to $metric, $value, $time, $labels, $label.<name> or a template
+	MappingRoot   string            `mapstructure:"mapping_root"` // wraps the mapped array in an object under this key
+	BatchSize     int               `mapstructure:"batch_size"`
+	Success       HttpJsonSuccess   `mapstructure:"success"`
+	Timeout       int               `mapstructure:"timeout"`
+	Retries       int               `mapstructure:"retries"`
+	RetryBackoff  int               `mapstructure:"retry_backoff"`
+	SpoolDir      string            `mapstructure:"spool_dir"`
+	SpoolMaxFiles int               `mapstructure:"spool_max_files"`
+	StaticConfigs []staticConfig    `mapstructure:"static_configs"`
+}
+
+// HttpJsonSuccess is the condition a response must meet for the request to count as delivered
+type HttpJsonSuccess struct {
+	StatusCodes []int    `mapstructure:"status_codes"` // any 2xx when empty
+	BodyField   string   `mapstructure:"body_field"`   // dot separated path into the json response
+	BodyValues  []string `mapstructure:"body_values"`
+}
+
+// ScrapeConfigS is a job of targets found by service discovery, in the shape of a Prometheus scrape_config
+type ScrapeConfigS struct {
+	JobName        string           `mapstructure:"job_name"`
+	Scheme         string           `mapstructure:"scheme"`       // http by default
+	MetricsPath    string           `mapstructure:"metrics_path"` // /metrics by default
+	FileSDConfigs  []FileSDConfigS  `mapstructure:"file_sd_configs"`
+	DNSSDConfigs   []DNSSDConfigS   `mapstructure:"dns_sd_configs"`
+	RelabelConfigs []RelabelConfigS `mapstructure:"relabel_configs"`
+}
+
+// FileSDConfigS reads target groups from json or yaml files, as Prometheus file_sd_configs do
+type FileSDConfigS struct {
+	Files           []string      `mapstructure:"files"` // the last path element may be a glob
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// DNSSDConfigS resolves names to targets, as Prometheus dns_sd_configs do
+type DNSSDConfigS struct {
+	Names           []string      `mapstructure:"names"`
+	Type            string        `mapstructure:"type"` // SRV, A or AAAA, SRV by default
+	Port            int           `mapstructure:"port"` // for A and AAAA, SRV records have their own
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// DestinationSDS adds the addresses resolved by DNSSDConfigs to the destinations of a sink
+// as Scheme://address/Path
+type DestinationSDS struct {
+	DNSSDConfigs []DNSSDConfigS `mapstructure:"dns_sd_configs"`
+	Scheme       string         `mapstructure:"scheme"` // http by default
+	Path         string         `mapstructure:"path"`
+	Mode         string         `mapstructure:"mode"` // fanout sends to every destination, failover to the first that accepts
+}
+
+// RelabelConfigS is a Prometheus relabel_config, unset fields take the Prometheus defaults
+type RelabelConfigS struct {
+	SourceLabels []string `mapstructure:"source_labels" yaml:"source_labels,omitempty"`
+	Separator    *string  `mapstructure:"separator" yaml:"separator,omitempty"`
+	Regex        string   `mapstructure:"regex" yaml:"regex,omitempty"`
+	Modulus      uint64   `mapstructure:"modulus" yaml:"modulus,omitempty"`
+	TargetLabel  string   `mapstructure:"target_label" yaml:"target_label,omitempty"`
+	Replacement  *string  `mapstructure:"replacement" yaml:"replacement,omitempty"`
+	Action       string   `mapstructure:"action" yaml:"action,omitempty"`
+}
+
+// SourcesS are the metric sources read inside the agent, their metrics reach every sink
+type SourcesS struct {
+	Process  []ProcessS `mapstructure:"process"`
+	Textfile TextfileS  `mapstructure:"textfile"`
+	Exec     []ExecS    `mapstructure:"exec"`
+	Probe    []ProbeS   `mapstructure:"probe"`
+}
+
+// TextfileS reads the *.prom files of Directory, as written for the node_exporter textfile collector
+type TextfileS struct {
+	Directory string `mapstructure:"directory"`
+}
+
+// ProcessS watches the processes matching every regex that is set, or the pid in Pidfile
+type ProcessS struct {
+	Name         string `mapstructure:"name"`          // name label of the watched group
+	NameRegex    string `mapstructure:"name_regex"`    // matched against the process name
+	CmdlineRegex string `mapstructure:"cmdline_regex"` // matched against the arguments joined by spaces
+	Pidfile      string `mapstructure:"pidfile"`
+}
+
+// ExecS runs Command, which prints Prometheus text exposition to stdout, every scrape interval
+type ExecS struct {
+	Name    string   `mapstructure:"name"`
+	Command []string `mapstructure:"command"` // program and arguments, not run through a shell
+	Timeout int      `mapstructure:"timeout"` // seconds, the process group is killed after it
+	Env     []string `mapstructure:"env"`     // KEY=value added to the environment of the agent
+	Dir     string   `mapstructure:"dir"`
+}
+
+// ProbeS checks Target every scrape interval, with the http module Target is a url, with the
+// tcp module host:port
+type ProbeS struct {
+	Name               string `mapstructure:"name"`
+	Module             string `mapstructure:"module"` // http or tcp
+	Target             string `mapstructure:"target"`
+	Timeout            int    `mapstructure:"timeout"`            // seconds
+	ValidStatusCodes   []int  `mapstructure:"valid_status_codes"` // 2xx when empty
+	BodyRegex          string `mapstructure:"body_regex"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// ReceiverS accepts metrics pushed to the agent on ListenAddress, an empty address disables it
+type ReceiverS struct {
+	ListenAddress  string           `mapstructure:"listen_address"`
+	MaxAge         time.Duration    `mapstructure:"max_age"` // a series not received again within it is dropped
+	RelabelConfigs []RelabelConfigS `mapstructure:"relabel_configs"`
+	Pushgateway    PushReceiverS    `mapstructure:"pushgateway"`
+}
+
+// PushReceiverS serves the Pushgateway API on the receiver listen address, the pushed groups
+// are saved to PersistenceFile every PersistenceInterval when it is set
+type PushReceiverS struct {
+	IsUse               bool          `mapstructure:"is_use"`
+	PersistenceFile     string        `mapstructure:"persistence_file"`
+	PersistenceInterval time.Duration `mapstructure:"persistence_interval"`
+}
+
+type StdoutS struct {
+	IsUse  bool              `mapstructure:"is_use"`
+	Format string            `mapstructure:"format"`
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+type FileS struct {
+	IsUse          bool              `mapstructure:"is_use"`
+	Path           string            `mapstructure:"path"`
+	FileName       string            `mapstructure:"file_name"`
+	Format         string            `mapstructure:"format"`
+	MaxSize        int               `mapstructure:"max_size"`
+	MaxBackups     int               `mapstructure:"max_backups"`
+	RotateInterval int               `mapstructure:"rotate_interval"`
+	Compress       bool              `mapstructure:"compress"`
+	Labels         map[string]string `mapstructure:"labels"`
 }
 
 /*
@@ -75,6 +280,17 @@ func NewSetting(configs string) (*Setting, error) {
 	return &Setting{vp: vp}, nil
 }
 
+// NewSettingFromReader read the config from in, configType is the viper config type such as yaml
+func NewSettingFromReader(in io.Reader, configType string) (*Setting, error) {
+	vp := viper.New()
+	vp.SetConfigType(configType)
+	if err := vp.ReadConfig(in); err != nil {
+		return nil, err
+	}
+
+	return &Setting{vp: vp}, nil
+}
+
 func (s *Setting) ReadSection(k string, v interface{}) error {
 	err := s.vp.UnmarshalKey(k, v)
 	if err != nil {